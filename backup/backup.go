@@ -2,17 +2,21 @@ package backup
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/bmatcuk/doublestar/v4"
 	"github.com/kennyparsons/gitbak/config"
+	"github.com/kennyparsons/gitbak/internal/crypt"
+	"github.com/kennyparsons/gitbak/internal/redact"
 	"github.com/kennyparsons/gitbak/internal/utils"
 )
 
@@ -88,82 +92,201 @@ func shouldIgnore(fullPath string, ignores []string) (bool, string, error) {
 	return matched, matchedPattern, nil
 }
 
-// copyDir recursively copies a directory tree: srcDir → dstDir
-// The destination directory will be created if it doesn't exist
-// The source directory's basename will be preserved in the destination
-func copyDir(srcDir, dstDir string, dryRun bool, globalIgnores []string, appName string) error {
-	if dryRun {
-		fmt.Printf("[dry-run] CopyDir %s → %s\n", srcDir, dstDir)
-		return nil
-	}
+// entry is a single file or directory visited while walking an app path.
+type entry struct {
+	src     string      // live path
+	dst     string      // destination under backup_dir/<app>
+	rel     string      // path relative to the app path root ("." for the root itself)
+	info    os.FileInfo // nil if src does not exist; describes the link itself for unfollowed symlinks
+	ignored string      // matched global ignore pattern, empty if not ignored
+	link    string      // target of src if it is a symlink that is not followed
+	// dangling is set for symlinks whose target doesn't exist
+	dangling bool
+	// skipped explains why a symlink is left out of the backup, empty if it
+	// isn't
+	skipped string
+}
 
-	// Create the destination directory if it doesn't exist
-	if err := os.MkdirAll(dstDir, 0755); err != nil {
-		return fmt.Errorf("failed to create destination directory: %v", err)
-	}
+// isLink reports whether the entry is a symlink to be stored as a link
+func (e entry) isLink() bool {
+	return e.link != "" && e.skipped == ""
+}
 
-	// Get source directory info to preserve permissions
-	srcInfo, err := os.Stat(srcDir)
+// walkAppPath walks srcPath the way a backup does and calls fn for every file
+// and directory it visits, including the root itself. Entries matching
+// globalIgnores are reported with their pattern set and, for directories,
+// their contents are not visited. A missing srcPath is reported once with a
+// nil info.
+//
+// Symlinks are handled according to symlinks (one of the config.Symlinks*
+// modes). Preserved links are reported with their target in link. Followed
+// links are reported like the file or directory they point to, except for
+// dangling links and links back to a directory being walked, which are
+// reported as skipped. With SymlinksSkip, every link is reported as skipped.
+func walkAppPath(srcPath, dstPath string, globalIgnores []string, symlinks string, fn func(entry) error) error {
+	info, err := os.Lstat(srcPath)
 	if err != nil {
-		return fmt.Errorf("failed to stat source directory: %v", err)
+		return fn(entry{src: srcPath, dst: dstPath, rel: "."})
 	}
 
-	// Ensure destination directory has the same permissions as source
-	if err := os.Chmod(dstDir, srcInfo.Mode()); err != nil {
-		return fmt.Errorf("failed to set directory permissions: %v", err)
+	// Check if the root of the custom app path should be ignored
+	ignore, matchedPattern, err := shouldIgnore(srcPath, globalIgnores)
+	if err != nil {
+		return fmt.Errorf("checking ignore for %s: %v", srcPath, err)
+	}
+	if ignore {
+		return fn(entry{src: srcPath, dst: dstPath, rel: ".", info: info, ignored: matchedPattern})
 	}
 
-	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	w := &walker{globalIgnores: globalIgnores, symlinks: symlinks, fn: fn}
+	return w.walk(entry{src: srcPath, dst: dstPath, rel: ".", info: info}, nil)
+}
 
-		// Calculate the relative path from srcDir to the current path
-		relPath, err := filepath.Rel(srcDir, path)
+// walker carries the settings of a single walkAppPath call
+type walker struct {
+	globalIgnores []string
+	symlinks      string
+	fn            func(entry) error
+}
+
+// walk visits e and, if it is a directory, everything beneath it. ancestors
+// are the directories being walked above e, used to detect symlink loops.
+func (w *walker) walk(e entry, ancestors []os.FileInfo) error {
+	if e.info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(e.src)
 		if err != nil {
-			return fmt.Errorf("error getting relative path: %v", err)
+			return fmt.Errorf("failed to read symlink %s: %v", e.src, err)
+		}
+		resolved, statErr := os.Stat(e.src)
+		e.dangling = statErr != nil
+
+		switch {
+		case w.symlinks == config.SymlinksSkip:
+			e.link, e.skipped = target, "symlinks set to skip"
+			return w.fn(e)
+		case w.symlinks == config.SymlinksPreserve:
+			e.link = target
+			return w.fn(e)
+		case e.dangling:
+			e.link, e.skipped = target, "dangling symlink"
+			return w.fn(e)
+		case resolved.IsDir() && isAncestor(resolved, ancestors):
+			e.link, e.skipped = target, "symlink loop"
+			return w.fn(e)
 		}
+		// Follow the link and back up what it points to
+		e.info = resolved
+	}
 
-		// Skip the root directory itself from ignore checks
-		if path == srcDir {
-			return nil
+	if err := w.fn(e); err != nil {
+		return err
+	}
+	if !e.info.IsDir() {
+		return nil
+	}
+
+	children, err := os.ReadDir(e.src)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %s: %v", e.src, err)
+	}
+	ancestors = append(ancestors, e.info)
+	for _, child := range children {
+		c := entry{
+			src: filepath.Join(e.src, child.Name()),
+			dst: filepath.Join(e.dst, child.Name()),
+			rel: filepath.Join(e.rel, child.Name()),
+		}
+		if c.info, err = child.Info(); err != nil {
+			return err
 		}
 
-		// Check if the current path should be ignored
-		ignore, matchedPattern, err := shouldIgnore(path, globalIgnores)
+		ignore, matchedPattern, err := shouldIgnore(c.src, w.globalIgnores)
 		if err != nil {
-			return fmt.Errorf("error checking ignore for %s: %v", path, err)
+			return fmt.Errorf("error checking ignore for %s: %v", c.src, err)
 		}
 		if ignore {
-			if info.IsDir() {
-				fmt.Printf("  %s: Ignored directory %s (globally ignored with \"%s\")\n", appName, relPath, matchedPattern)
-				return filepath.SkipDir // Skip this directory and its contents
+			// Ignored directories are reported but not descended into
+			c.ignored = matchedPattern
+			if err := w.fn(c); err != nil {
+				return err
 			}
-			fmt.Printf("  %s: Ignored file %s (globally ignored with \"%s\")\n", appName, relPath, matchedPattern)
-			return nil // Skip this file
+			continue
 		}
 
-		targetPath := filepath.Join(dstDir, relPath)
+		if err := w.walk(c, ancestors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		if info.IsDir() {
-			// Create the directory with the same permissions as source
-			if err := os.MkdirAll(targetPath, info.Mode()); err != nil {
-				return fmt.Errorf("failed to create directory %s: %v", targetPath, err)
-			}
-			// Set directory permissions
-			return os.Chmod(targetPath, info.Mode())
+// isAncestor reports whether dir is one of the directories being walked
+func isAncestor(dir os.FileInfo, ancestors []os.FileInfo) bool {
+	for _, a := range ancestors {
+		if os.SameFile(dir, a) {
+			return true
 		}
+	}
+	return false
+}
+
+// copySymlink stores a symlink in the backup tree, replacing whatever is at
+// dst, and reports whether it was added, changed or already up to date
+func copySymlink(target, dst string, dryRun bool) (Change, error) {
+	change := compareLink(target, dst)
+	if change == Unchanged {
+		return change, nil
+	}
+	if dryRun {
+		fmt.Printf("[dry-run] Symlink %s → %s\n", dst, target)
+		return change, nil
+	}
 
-		// For files, copy directly to the target path
-		return copyFile(path, targetPath, dryRun, globalIgnores, appName)
-	})
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return change, fmt.Errorf("failed to create destination directory: %v", err)
+	}
+	// Whatever was backed up here before, it's only a copy
+	if err := os.RemoveAll(dst); err != nil {
+		return change, fmt.Errorf("failed to replace %s: %v", dst, err)
+	}
+	if err := os.Symlink(target, dst); err != nil {
+		return change, fmt.Errorf("failed to create symlink: %v", err)
+	}
+	return change, nil
 }
 
-// copyFile copies a single file to the specified destination path
-// dstPath can be either:
+// copyDirEntry creates a single directory in the backup tree with the same
+// permissions as its source
+func copyDirEntry(srcInfo os.FileInfo, dstDir string, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+
+	// A symlink stored here by an earlier backup would lead MkdirAll, and
+	// everything copied into the directory, out of the backup tree
+	if info, err := os.Lstat(dstDir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(dstDir); err != nil {
+			return fmt.Errorf("failed to replace symlink %s: %v", dstDir, err)
+		}
+	}
+
+	// Create the destination directory if it doesn't exist
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dstDir, err)
+	}
+
+	// Ensure destination directory has the same permissions as source
+	if err := os.Chmod(dstDir, srcInfo.Mode()); err != nil {
+		return fmt.Errorf("failed to set directory permissions: %v", err)
+	}
+	return nil
+}
+
+// copyFile copies a single file to the specified destination path, encrypting
+// it if key is not nil. dstPath can be either:
 // - A directory: file will be placed inside it with its original name
 // - A file path: will be used as the exact destination path
-func copyFile(srcFile, dstPath string, dryRun bool, globalIgnores []string, appName string) error {
+func copyFile(srcFile, dstPath string, key *crypt.Key, dryRun bool) error {
 	// Get source file info to preserve permissions
 	srcInfo, err := os.Stat(srcFile)
 	if err != nil {
@@ -181,11 +304,6 @@ func copyFile(srcFile, dstPath string, dryRun bool, globalIgnores []string, appN
 	// If destination is a directory, append the source filename
 	if dstIsDir {
 		dstPath = filepath.Join(dstPath, filepath.Base(srcFile))
-	} else {
-		// Ensure the parent directory exists
-		if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
-			return fmt.Errorf("failed to create destination directory: %v", err)
-		}
 	}
 
 	if dryRun {
@@ -193,6 +311,11 @@ func copyFile(srcFile, dstPath string, dryRun bool, globalIgnores []string, appN
 		return nil
 	}
 
+	// Ensure the parent directory exists
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %v", err)
+	}
+
 	// Open source file
 	src, err := os.Open(srcFile)
 	if err != nil {
@@ -200,15 +323,18 @@ func copyFile(srcFile, dstPath string, dryRun bool, globalIgnores []string, appN
 	}
 	defer src.Close()
 
-	// Create destination file with the same permissions as source
-	dst, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, srcInfo.Mode())
-	if err != nil {
-		return fmt.Errorf("failed to create destination file: %v", err)
+	var contents io.Reader = src
+	if key != nil {
+		plaintext, err := io.ReadAll(src)
+		if err != nil {
+			return fmt.Errorf("failed to read source file: %v", err)
+		}
+		contents = bytes.NewReader(key.Encrypt(plaintext))
 	}
-	defer dst.Close()
 
-	// Copy the file contents
-	if _, err = io.Copy(dst, src); err != nil {
+	// Replace the backup copy atomically with the same permissions as
+	// source, so an interrupted copy never leaves a truncated file behind
+	if err := utils.WriteFileAtomic(dstPath, contents, srcInfo.Mode().Perm()); err != nil {
 		return fmt.Errorf("failed to copy file contents: %v", err)
 	}
 
@@ -220,151 +346,201 @@ func copyFile(srcFile, dstPath string, dryRun bool, globalIgnores []string, appN
 	return nil
 }
 
-// PerformBackup copies all files for custom apps
-func PerformBackup(cfg *config.Config, dryRun bool, overrides []utils.PathOverride) error {
-	var wg sync.WaitGroup
-	// Use a channel to collect errors from goroutines
-	errChan := make(chan error, len(cfg.CustomApps))
-	// Channel to send collected metadata from goroutines
-	metadataChan := make(chan FileMetadata, len(cfg.CustomApps)*100) // Buffer size is an estimate
-
-	// Process custom apps in parallel
-	for appName, appCfg := range cfg.CustomApps {
-		wg.Add(1)
-		go func(appName string, appCfg config.AppConfig) {
-			defer wg.Done()
-
-			fmt.Printf("Processing custom app: %s\n", appName)
-
-			// Execute pre-backup script if defined
-			if appCfg.PreBackupScript != "" {
-				scriptPath := utils.ExpandPath(appCfg.PreBackupScript, overrides)
-				fmt.Printf("  %s: Running pre-backup script: %s\n", appName, scriptPath)
-				if !dryRun {
-					cmd := exec.Command("bash", "-c", scriptPath)
-					var stdoutBuf, stderrBuf bytes.Buffer
-					cmd.Stdout = &stdoutBuf
-					cmd.Stderr = &stderrBuf
-					cmdErr := cmd.Run() // Store the error
-
-					// Print stdout
-					if stdout := stdoutBuf.String(); stdout != "" {
-						for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
-							fmt.Printf("  %s: Pre-backup script stdout: %s\n", appName, line)
-						}
-					}
-					// Print stderr
-					if stderr := stderrBuf.String(); stderr != "" {
-						for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
-							fmt.Printf("  %s: Pre-backup script stderr: %s\n", appName, line)
-						}
-					}
-
-					if cmdErr != nil { // Now check the error and return if necessary
-						errChan <- fmt.Errorf("%s: pre-backup script failed: %v", appName, cmdErr)
-						return
-					}
-				}
-			}
+// Options controls how PerformBackup behaves
+type Options struct {
+	DryRun bool
+	// Checksum compares file contents to find changed files instead of
+	// trusting size and modification time
+	Checksum bool
+	// Jobs is the number of files copied in parallel. Zero or less uses one
+	// per CPU.
+	Jobs int
+}
 
-			dstRoot := filepath.Join(cfg.BackupDir, appName)
+// PerformBackup copies the files of all custom apps that changed since the
+// last backup and returns which files it added, modified or deleted in each
+// app's backup.
+//
+// If ctx is cancelled, running pre-backup scripts are killed, files being
+// copied are finished and nothing else is started. Stale files are not pruned,
+// and the metadata file is only updated for the files that were copied, so
+// every file in the backup tree is whole, matches its metadata and the tree
+// can simply be backed up again.
+func PerformBackup(ctx context.Context, cfg *config.Config, opts Options, overrides []utils.PathOverride) (*Result, error) {
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
 
-			for _, rawPath := range appCfg.Paths {
+	b := &backupRun{
+		cfg:       cfg,
+		opts:      opts,
+		overrides: overrides,
+		previous:  make(map[string]string),
+		tasks:     make(chan fileTask, jobs),
 
-				srcPath := utils.ExpandPath(rawPath, overrides)
-				srcBase := filepath.Base(srcPath)
-				dstPath := filepath.Join(dstRoot, srcBase)
+		secrets:       make(map[string]string),
+		secretSources: make(map[string]string),
+	}
 
-				info, err := os.Stat(srcPath)
-				if err != nil {
-					fmt.Printf("  %s: Skipped %s (does not exist)\n", appName, srcPath)
-					continue
-				}
+	// Checksums of unchanged files are carried over from the last backup
+	// instead of hashing every file again
+	if metadata, err := LoadMetadata(cfg.BackupDir); err == nil {
+		for _, meta := range metadata.Files() {
+			b.previous[meta.Path] = meta.SHA256
+		}
+	}
 
-				// Check if the root of the custom app path should be ignored
-				ignore, matchedPattern, err := shouldIgnore(srcPath, cfg.GlobalIgnores)
-				if err != nil {
-					errChan <- fmt.Errorf("%s: checking ignore for %s: %v", appName, srcPath, err)
-					continue
-				}
-				if ignore {
-					fmt.Printf("  %s: Ignored %s (matched global ignore pattern \"%s\")\n", appName, srcPath, matchedPattern)
-					continue // Skip this entire app path
+	var names []string
+	for name := range cfg.CustomApps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	apps := make([]*appRun, len(names))
+	var key *crypt.Key
+	for i, name := range names {
+		symlinks, err := cfg.SymlinkMode(cfg.CustomApps[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		rules, err := redact.Compile(cfg.CustomApps[name].Redact)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		apps[i] = &appRun{
+			name:     name,
+			cfg:      cfg.CustomApps[name],
+			symlinks: symlinks,
+			redact:   rules,
+			dstRoot:  filepath.Join(cfg.BackupDir, name),
+			result:   AppResult{Name: name},
+			produced: make(map[string]bool),
+			kept:     make(map[string]bool),
+		}
+		if apps[i].cfg.Encrypt {
+			if key == nil {
+				var err error
+				if key, err = encryptionKey(cfg, opts.DryRun); err != nil {
+					return nil, err
 				}
+			}
+			apps[i].key = key
+		}
+	}
 
-				// Collect metadata within the goroutine
-				meta, err := collectFileMetadata(srcPath, filepath.Dir(srcPath))
-				if err != nil {
-					fmt.Printf("  %s: Failed to collect metadata for %s: %v\n", appName, srcPath, err)
-				} else {
-					meta.Path = filepath.Join(appName, filepath.Base(srcPath))
-					metadataChan <- meta // Send metadata to channel
-				}
+	// Start the copy workers
+	var copiers sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		copiers.Add(1)
+		go func() {
+			defer copiers.Done()
+			b.copyFiles(ctx)
+		}()
+	}
 
-				if info.IsDir() {
-					if err := copyDir(srcPath, dstPath, dryRun, cfg.GlobalIgnores, appName); err != nil {
-						errChan <- fmt.Errorf("%s: copying directory %s: %v", appName, srcPath, err)
-						continue
-					}
-				} else {
-					// Check if the file itself should be ignored
-					// For single files, the pattern should match the full path relative to the source root
-					// Here, we consider the file's path relative to its parent directory for ignore matching
-					ignore, matchedPattern, err := shouldIgnore(srcPath, cfg.GlobalIgnores)
-					if err != nil {
-						errChan <- fmt.Errorf("%s: checking ignore for %s: %v", appName, srcPath, err)
-						continue
-					}
-					if ignore {
-						fmt.Printf("  %s: Ignored file %s (globally ignored with \"%s\")\n", appName, srcPath, matchedPattern)
-						continue
-					}
-
-					if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
-						errChan <- fmt.Errorf("%s: creating directory %s: %v", appName, filepath.Dir(dstPath), err)
-						continue
-					}
-					if err := copyFile(srcPath, dstPath, dryRun, cfg.GlobalIgnores, appName); err != nil {
-						errChan <- fmt.Errorf("%s: copying file %s: %v", appName, srcPath, err)
-						continue
-					}
-				}
-			}
-			fmt.Printf("Finished processing custom app: %s\n", appName)
-		}(appName, appCfg)
+	// Walk at most jobs apps at a time, feeding the workers
+	var walkers sync.WaitGroup
+	slots := make(chan struct{}, jobs)
+	for _, app := range apps {
+		walkers.Add(1)
+		go func(app *appRun) {
+			defer walkers.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			b.walkApp(ctx, app)
+		}(app)
+	}
+	walkers.Wait()
+	close(b.tasks)
+	copiers.Wait()
+
+	if err := ctx.Err(); err != nil {
+		fmt.Println("Backup interrupted; stale files were not removed and metadata was only saved for the files copied")
+		if !opts.DryRun {
+			b.savePartial(apps)
+		}
+		return nil, fmt.Errorf("backup interrupted: %w", err)
 	}
 
-	// Wait for all goroutines to finish
-	wg.Wait()
+	result := &Result{}
+	allMetadata := make(map[string][]FileMetadata)
+	keptPaths := make(map[string][]string)
+	for _, app := range apps {
+		if app.skipped {
+			continue
+		}
 
-	// Close the metadata channel once all workers are done
-	close(metadataChan)
+		// Only prune after a clean run, so a partial copy never deletes
+		// files that simply weren't reached
+		if !app.failed {
+			removed, err := pruneStale(app.name, app.dstRoot, app.produced, app.kept, cfg.GlobalIgnores, opts.DryRun)
+			app.result.Deleted = removed
+			if err != nil {
+				b.fail(app, fmt.Errorf("%s: removing stale files: %v", app.name, err))
+			}
+		}
 
-	// Collect metadata from the channel in the main goroutine
-	var allMetadata []FileMetadata
-	for meta := range metadataChan {
-		allMetadata = append(allMetadata, meta)
+		fmt.Printf("  %s: %d copied, %d skipped (unchanged)\n", app.name, len(app.result.Added)+len(app.result.Modified), app.result.Unchanged)
+		fmt.Printf("Finished processing custom app: %s\n", app.name)
+		result.Apps = append(result.Apps, app.result)
+		allMetadata[app.name] = app.metadata
+		for path := range app.kept {
+			if rel, err := filepath.Rel(cfg.BackupDir, path); err == nil {
+				keptPaths[app.name] = append(keptPaths[app.name], rel)
+			}
+		}
 	}
+	result.sort()
 
-	// Close the error channel and collect errors
-	close(errChan)
-	var allErrors []error
-	for err := range errChan {
-		allErrors = append(allErrors, err)
+	// Keep the redacted values on this machine, even if some files failed,
+	// so the copies that were written can still be restored
+	if !opts.DryRun && len(b.secrets) > 0 {
+		if err := redact.SaveStore(redact.StorePath(cfg), b.secrets); err != nil {
+			b.errs = append(b.errs, err)
+		}
 	}
 
-	// If any errors occurred, return the first one (or a combined error)
-	if len(allErrors) > 0 {
-		return fmt.Errorf("errors during backup: %v", allErrors)
+	// If any errors occurred, return them all
+	if len(b.errs) > 0 {
+		return result, fmt.Errorf("errors during backup: %v", b.errs)
 	}
 
 	// Save metadata
-	if !dryRun && len(allMetadata) > 0 {
-		if err := saveMetadata(cfg.BackupDir, allMetadata); err != nil {
-			return fmt.Errorf("failed to save metadata: %v", err)
+	if !opts.DryRun && len(allMetadata) > 0 {
+		saved, err := saveMetadata(cfg.BackupDir, cfg.Host(), allMetadata, keptPaths)
+		if err != nil {
+			return result, fmt.Errorf("failed to save metadata: %v", err)
+		}
+		if saved {
+			fmt.Println("✓ Saved file metadata")
 		}
-		fmt.Println("✓ Saved file metadata")
 	}
 
-	return nil
+	return result, nil
+}
+
+// savePartial saves what an interrupted run did record: the secrets taken out
+// of redacted copies, and the metadata of the files that were copied. Every
+// other entry of an app is carried over from the last backup, as the run may
+// not have reached it.
+func (b *backupRun) savePartial(apps []*appRun) {
+	if len(b.secrets) > 0 {
+		if err := redact.SaveStore(redact.StorePath(b.cfg), b.secrets); err != nil {
+			fmt.Printf("Failed to save redacted values: %v\n", err)
+		}
+	}
+	recorded := make(map[string][]FileMetadata)
+	kept := make(map[string][]string)
+	for _, app := range apps {
+		if len(app.metadata) > 0 {
+			recorded[app.name] = app.metadata
+			kept[app.name] = []string{app.name}
+		}
+	}
+	if len(recorded) == 0 {
+		return
+	}
+	if _, err := saveMetadata(b.cfg.BackupDir, b.cfg.Host(), recorded, kept); err != nil {
+		fmt.Printf("Failed to save metadata: %v\n", err)
+	}
 }
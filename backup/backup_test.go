@@ -1,7 +1,16 @@
 package backup
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/kennyparsons/gitbak/config"
 )
 
 func TestShouldIgnore(t *testing.T) {
@@ -77,3 +86,462 @@ func TestShouldIgnore(t *testing.T) {
 		})
 	}
 }
+
+func TestPruneStale(t *testing.T) {
+	root := t.TempDir()
+	write := func(rel string) string {
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(rel), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", rel, err)
+		}
+		return path
+	}
+
+	keep := write("nvim/init.lua")
+	stale := write("nvim/lua/old.lua")
+	ignored := write("nvim/notes.bak")
+	missing := write("other/file")
+
+	produced := map[string]bool{
+		filepath.Join(root, "nvim"): true,
+		keep:                        true,
+	}
+	kept := map[string]bool{
+		filepath.Join(root, "other"): true,
+	}
+
+	removed, err := pruneStale("app", root, produced, kept, []string{"*.bak"}, false)
+	if err != nil {
+		t.Fatalf("pruneStale failed: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != filepath.Join("nvim", "lua", "old.lua") {
+		t.Errorf("pruneStale removed %v, want [nvim/lua/old.lua]", removed)
+	}
+
+	for _, path := range []string{keep, ignored, missing} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s to be kept: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", stale)
+	}
+	if _, err := os.Stat(filepath.Dir(stale)); !os.IsNotExist(err) {
+		t.Errorf("expected empty directory %s to be removed", filepath.Dir(stale))
+	}
+}
+
+func TestScan(t *testing.T) {
+	src := t.TempDir()
+	backupDir := t.TempDir()
+	write := func(path, content string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+
+	appDir := filepath.Join(src, "app")
+	write(filepath.Join(appDir, "same.conf"), "same")
+	write(filepath.Join(appDir, "changed.conf"), "new content")
+	write(filepath.Join(appDir, "added.conf"), "added")
+	write(filepath.Join(appDir, "cache.tmp"), "ignored")
+	write(filepath.Join(backupDir, "myapp", "app", "same.conf"), "same")
+	write(filepath.Join(backupDir, "myapp", "app", "changed.conf"), "old content")
+	write(filepath.Join(backupDir, "myapp", "app", "removed.conf"), "removed")
+
+	cfg := &config.Config{
+		BackupDir:     backupDir,
+		CustomApps:    map[string]config.AppConfig{"myapp": {Paths: []string{appDir}}},
+		GlobalIgnores: []string{"*.tmp"},
+	}
+
+	statuses, err := Scan(cfg, "", nil)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(statuses) != 1 || !statuses[0].Drifted() {
+		t.Fatalf("expected one drifted app, got %+v", statuses)
+	}
+
+	got := make(map[string]Change)
+	for _, f := range statuses[0].Files {
+		got[f.Path] = f.Change
+	}
+	want := map[string]Change{
+		"app/same.conf":    Unchanged,
+		"app/changed.conf": Modified,
+		"app/added.conf":   Added,
+		"app/removed.conf": Deleted,
+	}
+	if len(got) != len(want) {
+		t.Errorf("Scan returned %v, want %v", got, want)
+	}
+	for path, change := range want {
+		if got[path] != change {
+			t.Errorf("%s: got %v, want %v", path, got[path], change)
+		}
+	}
+}
+
+func TestSaveMetadataMerges(t *testing.T) {
+	root := t.TempDir()
+	legacy := `[{"path": "zsh/.zshrc", "mode": 420}, {"path": "nvim/nvim", "mode": 2147484141}]`
+	if err := os.WriteFile(filepath.Join(root, MetadataFileName), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Backing up nvim alone must keep the zsh section of the legacy file
+	nvim := []FileMetadata{{Path: "nvim/nvim/init.lua", Mode: 0644}, {Path: "nvim/nvim", Mode: os.ModeDir | 0755}}
+	if _, err := saveMetadata(root, "laptop", map[string][]FileMetadata{"nvim": nvim}, nil); err != nil {
+		t.Fatalf("saveMetadata() error = %v", err)
+	}
+
+	metadata, err := LoadMetadata(root)
+	if err != nil {
+		t.Fatalf("LoadMetadata() error = %v", err)
+	}
+	if metadata.SchemaVersion != MetadataSchemaVersion || metadata.Host != "laptop" {
+		t.Errorf("got schema version %d, host %q", metadata.SchemaVersion, metadata.Host)
+	}
+	if files := metadata.Apps["zsh"].Files; len(files) != 1 || files[0].Path != "zsh/.zshrc" {
+		t.Errorf("zsh files = %v, want the legacy entry", files)
+	}
+	files := metadata.Apps["nvim"].Files
+	if len(files) != 2 || files[0].Path != "nvim/nvim" || files[1].Path != "nvim/nvim/init.lua" {
+		t.Errorf("nvim files = %v, want the new entries sorted by path", files)
+	}
+}
+
+func TestSaveMetadataUnchanged(t *testing.T) {
+	root := t.TempDir()
+	apps := map[string][]FileMetadata{
+		"zsh":  {{Path: "zsh/.zshrc", Mode: 0644, Xattrs: []Xattr{}}},
+		"nvim": {{Path: "nvim/nvim", Mode: os.ModeDir | 0755, Xattrs: []Xattr{}}},
+	}
+	if _, err := saveMetadata(root, "laptop", apps, nil); err != nil {
+		t.Fatalf("saveMetadata() error = %v", err)
+	}
+	// Pretend the last backup was long ago
+	metadata, err := LoadMetadata(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const old = "2000-01-01T00:00:00Z"
+	metadata.Generated = old
+	for name, app := range metadata.Apps {
+		app.Generated = old
+		metadata.Apps[name] = app
+	}
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(root, MetadataFileName)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing changed, so nothing is written
+	if _, err := saveMetadata(root, "laptop", apps, nil); err != nil {
+		t.Fatalf("saveMetadata() error = %v", err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Errorf("saveMetadata() rewrote the file without any change:\n%s", got)
+	}
+
+	// Only the app that changed gets a new generated time
+	apps["nvim"] = []FileMetadata{{Path: "nvim/nvim", Mode: os.ModeDir | 0700, Xattrs: []Xattr{}}}
+	if _, err := saveMetadata(root, "laptop", apps, nil); err != nil {
+		t.Fatalf("saveMetadata() error = %v", err)
+	}
+	if metadata, err = LoadMetadata(root); err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Generated == old || metadata.Apps["nvim"].Generated == old {
+		t.Errorf("generated times of the file and nvim were not updated: %+v", metadata)
+	}
+	if metadata.Apps["zsh"].Generated != old {
+		t.Errorf("generated time of unchanged zsh = %s, want %s", metadata.Apps["zsh"].Generated, old)
+	}
+}
+
+func TestCompareFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("live"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := compareFile(src, dst, false, nil); err != nil || got != Added {
+		t.Errorf("compareFile() with missing copy = %v, %v, want %v", got, err, Added)
+	}
+
+	// Same size and mtime, different content: only a checksum notices
+	if err := os.WriteFile(dst, []byte("copy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := compareFile(src, dst, false, nil); err != nil || got != Unchanged {
+		t.Errorf("compareFile() fast path = %v, %v, want %v", got, err, Unchanged)
+	}
+	if got, err := compareFile(src, dst, true, nil); err != nil || got != Modified {
+		t.Errorf("compareFile() with checksum = %v, %v, want %v", got, err, Modified)
+	}
+}
+
+func TestPerformBackup(t *testing.T) {
+	src := t.TempDir()
+	backupDir := t.TempDir()
+
+	// More files than any channel buffer, spread over several apps
+	apps := make(map[string]config.AppConfig)
+	for _, app := range []string{"big", "small", "tiny"} {
+		dir := filepath.Join(src, app)
+		if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 150; i++ {
+			path := filepath.Join(dir, "sub", fmt.Sprintf("file%d", i))
+			if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		apps[app] = config.AppConfig{Paths: []string{dir}}
+	}
+	cfg := &config.Config{BackupDir: backupDir, CustomApps: apps}
+
+	result, err := PerformBackup(context.Background(), cfg, Options{Jobs: 2}, nil)
+	if err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	if len(result.Apps) != 3 {
+		t.Fatalf("got %d apps, want 3", len(result.Apps))
+	}
+	for _, app := range result.Apps {
+		if len(app.Added) != 150 {
+			t.Errorf("%s: %d files added, want 150", app.Name, len(app.Added))
+		}
+	}
+
+	metadata, err := LoadMetadata(backupDir)
+	if err != nil {
+		t.Fatalf("LoadMetadata failed: %v", err)
+	}
+	// Each app has its root, sub/ and 150 files
+	if files := len(metadata.Files()); files != 3*152 {
+		t.Errorf("metadata has %d entries, want %d", files, 3*152)
+	}
+
+	// A second run finds nothing to copy
+	result, err = PerformBackup(context.Background(), cfg, Options{Jobs: 2}, nil)
+	if err != nil {
+		t.Fatalf("second PerformBackup failed: %v", err)
+	}
+	if changed := result.ChangedApps(); len(changed) != 0 {
+		t.Errorf("second run changed %v", changed)
+	}
+}
+
+func TestWalkAppPathSymlinks(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "app")
+	if err := os.MkdirAll(filepath.Join(src, "real"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "real", "f"), []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{"dirlink": "real", "dangling": "nowhere", "real/loop": ".."} {
+		if err := os.Symlink(target, filepath.Join(src, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk := func(mode string) map[string]string {
+		got := make(map[string]string)
+		err := walkAppPath(src, "/backup/app", nil, mode, func(e entry) error {
+			switch {
+			case e.skipped != "":
+				got[e.rel] = "skipped: " + e.skipped
+			case e.isLink():
+				got[e.rel] = "link: " + e.link
+			case e.info.IsDir():
+				got[e.rel] = "dir"
+			default:
+				got[e.rel] = "file"
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("walkAppPath(%s) error = %v", mode, err)
+		}
+		return got
+	}
+
+	tests := map[string]map[string]string{
+		config.SymlinksFollow: {
+			".": "dir", "real": "dir", "real/f": "file",
+			"dirlink": "dir", "dirlink/f": "file", "dirlink/loop": "skipped: symlink loop",
+			"real/loop": "skipped: symlink loop", "dangling": "skipped: dangling symlink",
+		},
+		config.SymlinksPreserve: {
+			".": "dir", "real": "dir", "real/f": "file",
+			"dirlink": "link: real", "real/loop": "link: ..", "dangling": "link: nowhere",
+		},
+		config.SymlinksSkip: {
+			".": "dir", "real": "dir", "real/f": "file",
+			"dirlink": "skipped: symlinks set to skip", "real/loop": "skipped: symlinks set to skip",
+			"dangling": "skipped: symlinks set to skip",
+		},
+	}
+	for mode, want := range tests {
+		got := walk(mode)
+		if len(got) != len(want) {
+			t.Errorf("%s: got %v, want %v", mode, got, want)
+			continue
+		}
+		for rel, kind := range want {
+			if got[filepath.FromSlash(rel)] != kind {
+				t.Errorf("%s: %s = %q, want %q", mode, rel, got[filepath.FromSlash(rel)], kind)
+			}
+		}
+	}
+}
+
+func TestPerformBackupKeepsMetadataOfMissingSources(t *testing.T) {
+	src := t.TempDir()
+	backupDir := t.TempDir()
+	ssh := filepath.Join(src, ".ssh")
+	if err := os.MkdirAll(ssh, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(ssh, "id"), []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	zshrc := filepath.Join(src, ".zshrc")
+	if err := os.WriteFile(zshrc, []byte("zsh"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{BackupDir: backupDir, CustomApps: map[string]config.AppConfig{
+		"shell": {Paths: []string{ssh, zshrc}},
+	}}
+	if _, err := PerformBackup(context.Background(), cfg, Options{}, nil); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+
+	// Back up again on a machine without ~/.ssh
+	if err := os.RemoveAll(ssh); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PerformBackup(context.Background(), cfg, Options{}, nil); err != nil {
+		t.Fatalf("second PerformBackup failed: %v", err)
+	}
+
+	metadata, err := LoadMetadata(backupDir)
+	if err != nil {
+		t.Fatalf("LoadMetadata failed: %v", err)
+	}
+	modes := make(map[string]os.FileMode)
+	for _, meta := range metadata.Files() {
+		modes[meta.Path] = meta.Mode
+	}
+	for path, want := range map[string]os.FileMode{
+		filepath.Join("shell", ".ssh"):       os.ModeDir | 0700,
+		filepath.Join("shell", ".ssh", "id"): 0600,
+		filepath.Join("shell", ".zshrc"):     0644,
+	} {
+		if got, ok := modes[path]; !ok || got != want {
+			t.Errorf("metadata of %s = %v (recorded %v), want %v", path, got, ok, want)
+		}
+	}
+}
+
+func TestPerformBackupInterruptedKeepsMetadataConsistent(t *testing.T) {
+	src := t.TempDir()
+	backupDir := t.TempDir()
+	zshrc := filepath.Join(src, ".zshrc")
+	gitconfig := filepath.Join(src, ".gitconfig")
+	for path, content := range map[string]string{zshrc: "old zsh", gitconfig: "old git"} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &config.Config{BackupDir: backupDir, CustomApps: map[string]config.AppConfig{
+		"git": {Paths: []string{gitconfig}},
+		"zsh": {Paths: []string{zshrc}},
+	}}
+	if _, err := PerformBackup(context.Background(), cfg, Options{}, nil); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+
+	// zsh is copied while git's pre-backup script, and the child it
+	// started, hang until the backup is cancelled
+	for path, content := range map[string]string{zshrc: "new zsh", gitconfig: "new git"} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script := filepath.Join(src, "pre-backup.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/bash\nsleep 60 &\nwait\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg.CustomApps["git"] = config.AppConfig{Paths: []string{gitconfig}, PreBackupScript: script}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		copied := filepath.Join(backupDir, "zsh", ".zshrc")
+		for {
+			if data, _ := os.ReadFile(copied); string(data) == "new zsh" {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	if _, err := PerformBackup(ctx, cfg, Options{Jobs: 2}, nil); err == nil {
+		t.Fatal("PerformBackup succeeded despite being cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("PerformBackup took %v to stop, the script was not killed", elapsed)
+	}
+
+	// Every copy in the tree must match what the metadata says about it
+	metadata, err := LoadMetadata(backupDir)
+	if err != nil {
+		t.Fatalf("LoadMetadata failed: %v", err)
+	}
+	checked := 0
+	for _, meta := range metadata.Files() {
+		if meta.SHA256 == "" {
+			continue
+		}
+		sum, err := FileChecksum(filepath.Join(backupDir, meta.Path))
+		if err != nil {
+			t.Fatalf("FileChecksum failed: %v", err)
+		}
+		if sum != meta.SHA256 {
+			t.Errorf("%s doesn't match its metadata after the interrupted backup", meta.Path)
+		}
+		checked++
+	}
+	if checked != 2 {
+		t.Errorf("metadata has checksums for %d files, want 2", checked)
+	}
+	if data, _ := os.ReadFile(filepath.Join(backupDir, "git", ".gitconfig")); string(data) != "old git" {
+		t.Errorf("git/.gitconfig = %q, want the copy of the last backup", data)
+	}
+}
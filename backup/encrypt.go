@@ -0,0 +1,32 @@
+package backup
+
+import (
+	"os"
+
+	"github.com/kennyparsons/gitbak/config"
+	"github.com/kennyparsons/gitbak/internal/crypt"
+)
+
+// encryptionKey returns the key the files of apps with encrypt set are stored
+// with. The first encrypted backup creates it and saves its parameters in the
+// backup directory, unless dryRun is set.
+func encryptionKey(cfg *config.Config, dryRun bool) (*crypt.Key, error) {
+	passphrase, err := crypt.Passphrase(cfg.EncryptionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypt.LoadKey(cfg.BackupDir, passphrase)
+	if !os.IsNotExist(err) {
+		return key, err
+	}
+
+	if key, err = crypt.NewKey(passphrase); err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		if err := key.Save(cfg.BackupDir); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
@@ -2,60 +2,96 @@
 package backup
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
+
+	"github.com/kennyparsons/gitbak/internal/utils"
 )
 
 // FileMetadata contains all the metadata we want to preserve for a file
 type FileMetadata struct {
-	Path     string      `json:"path"`     // Relative path from backup root
-	Mode     os.FileMode `json:"mode"`     // File mode including permissions
-	Uid      int         `json:"uid"`      // User ID
-	Gid      int         `json:"gid"`      // Group ID
-	Xattrs   []Xattr     `json:"xattrs"`   // Extended attributes
-	Modified string      `json:"modified"` // Modification time
+	Path     string      `json:"path"`               // Relative path from backup root
+	Mode     os.FileMode `json:"mode"`               // File mode including permissions
+	Uid      int         `json:"uid"`                // User ID
+	Gid      int         `json:"gid"`                // Group ID
+	Xattrs   []Xattr     `json:"xattrs"`             // Extended attributes
+	Modified string      `json:"modified"`           // Modification time
+	SHA256   string      `json:"sha256,omitempty"`   // Checksum of the backup copy, for regular files only
+	Link     string      `json:"link,omitempty"`     // Target of a preserved symlink
+	Secrets  []string    `json:"secrets,omitempty"`  // Names of the secrets redacted from the file
+	Template bool        `json:"template,omitempty"` // Path is a template the live file is rendered from
 }
 
 // Xattr represents an extended attribute
 type Xattr struct {
 	Name  string `json:"name"`
-	Value string `json:"value"`
+	Value string `json:"value"` // Base64-encoded, as values may be binary
 }
 
 // MetadataFileName is the name of the metadata file in the backup
 const MetadataFileName = ".gitbak_metadata.json"
 
-// collectFileMetadata collects metadata for a file or directory
-func collectFileMetadata(path, basePath string) (FileMetadata, error) {
-	info, err := os.Lstat(path)
-	if err != nil {
-		return FileMetadata{}, err
+// MetadataSchemaVersion is the version of the metadata file format written by
+// this build. Version 1 is the original bare array of FileMetadata.
+const MetadataSchemaVersion = 2
+
+// GitbakVersion is recorded in the metadata file. main sets it at startup.
+var GitbakVersion = "dev"
+
+// Metadata is the content of the metadata file
+type Metadata struct {
+	SchemaVersion int                    `json:"schema_version"`
+	GitbakVersion string                 `json:"gitbak_version"`
+	Host          string                 `json:"host"`      // Machine that last wrote the file
+	Generated     string                 `json:"generated"` // When the file was last written
+	Apps          map[string]AppMetadata `json:"apps"`
+}
+
+// AppMetadata holds the metadata of a single app's files
+type AppMetadata struct {
+	Generated string         `json:"generated"` // When the app was last backed up
+	Files     []FileMetadata `json:"files"`
+}
+
+// Files returns the metadata of every file of every app
+func (m *Metadata) Files() []FileMetadata {
+	var files []FileMetadata
+	for _, app := range m.Apps {
+		files = append(files, app.Files...)
 	}
+	return files
+}
 
+// CollectFileMetadata collects metadata for a file, directory or symlink.
+// info describes path as it is backed up: the link itself for a preserved
+// symlink, what it points to for a followed one. The caller fills in Path.
+func CollectFileMetadata(path string, info os.FileInfo) (FileMetadata, error) {
 	// Get Unix-specific file info
 	sys, ok := info.Sys().(*syscall.Stat_t)
 	if !ok {
 		return FileMetadata{}, fmt.Errorf("could not get file stats")
 	}
 
-	// Get relative path
-	relPath, err := filepath.Rel(basePath, path)
-	if err != nil {
-		return FileMetadata{}, fmt.Errorf("failed to get relative path: %v", err)
-	}
-
-	// Collect extended attributes
-	xattrs, err := getXattrs(path)
-	if err != nil {
-		return FileMetadata{}, fmt.Errorf("failed to get xattrs: %v", err)
+	// Collect extended attributes; symlinks can't carry user.* ones
+	xattrs := []Xattr{}
+	if info.Mode()&os.ModeSymlink == 0 {
+		var err error
+		if xattrs, err = getXattrs(path); err != nil {
+			return FileMetadata{}, fmt.Errorf("failed to get xattrs: %v", err)
+		}
 	}
 
 	return FileMetadata{
-		Path:     relPath,
 		Mode:     info.Mode(),
 		Uid:      int(sys.Uid),
 		Gid:      int(sys.Gid),
@@ -64,35 +100,180 @@ func collectFileMetadata(path, basePath string) (FileMetadata, error) {
 	}, nil
 }
 
-// saveMetadata saves metadata to the backup directory
-func saveMetadata(backupRoot string, metadata []FileMetadata) error {
+// FileChecksum returns the hex-encoded SHA-256 of a file's contents
+func FileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// saveMetadata writes the metadata of the apps backed up in this run to the
+// backup directory. Sections of apps that weren't part of the run are kept
+// from the existing file, which is migrated to the current format if needed.
+// kept lists, by app, the paths relative to backupRoot that the run left
+// alone because their source is missing; their entries are carried over too,
+// unless the run recorded the same path again. An app's generated time only
+// moves when its files changed, and the file isn't written at all if nothing
+// did, so a backup that changed nothing leaves nothing to commit. It reports
+// whether the file was written.
+func saveMetadata(backupRoot, host string, apps map[string][]FileMetadata, kept map[string][]string) (bool, error) {
+	metadata, err := LoadMetadata(backupRoot)
+	exists := err == nil
+	if os.IsNotExist(err) {
+		metadata = &Metadata{}
+	} else if err != nil {
+		return false, err
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	changed := !exists || metadata.SchemaVersion != MetadataSchemaVersion ||
+		metadata.GitbakVersion != GitbakVersion || metadata.Host != host
+	metadata.SchemaVersion = MetadataSchemaVersion
+	metadata.GitbakVersion = GitbakVersion
+	metadata.Host = host
+	if metadata.Apps == nil {
+		metadata.Apps = make(map[string]AppMetadata)
+	}
+	for name, files := range apps {
+		recorded := make(map[string]bool, len(files))
+		for _, meta := range files {
+			recorded[meta.Path] = true
+		}
+		prevApp, hadApp := metadata.Apps[name]
+		for _, prev := range prevApp.Files {
+			if !recorded[prev.Path] && isKept(prev.Path, kept[name]) {
+				files = append(files, prev)
+			}
+		}
+		// Apps finish in any order; keep the file stable between runs
+		sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+		if hadApp && sameFiles(prevApp.Files, files) {
+			continue
+		}
+		metadata.Apps[name] = AppMetadata{Generated: now, Files: files}
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	metadata.Generated = now
+
 	metadataPath := filepath.Join(backupRoot, MetadataFileName)
 	data, err := json.MarshalIndent(metadata, "", "  ")
 	if err != nil {
-		return fmt.Errorf("failed to marshal metadata: %v", err)
+		return false, fmt.Errorf("failed to marshal metadata: %v", err)
 	}
-	return os.WriteFile(metadataPath, data, 0644)
+	if err := utils.WriteFileAtomic(metadataPath, bytes.NewReader(data), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-// loadMetadata loads metadata from the backup directory
-func loadMetadata(backupRoot string) ([]FileMetadata, error) {
-	metadataPath := filepath.Join(backupRoot, MetadataFileName)
-	data, err := os.ReadFile(metadataPath)
+// sameFiles reports whether two lists of file metadata would be written out
+// the same way
+func sameFiles(a, b []FileMetadata) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(dataA, dataB)
+}
+
+// MergeMetadata merges two versions of the metadata file that were written
+// on different machines since they last synced. ours holds the local backup,
+// which decides the sections of apps, the apps it changed; every other app's
+// section is taken from theirs, which may have backed it up since.
+func MergeMetadata(ours, theirs []byte, apps []string) ([]byte, error) {
+	local, err := parseMetadata(ours)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read metadata file: %v", err)
+		return nil, err
+	}
+	remote, err := parseMetadata(theirs)
+	if err != nil {
+		return nil, err
 	}
 
-	var metadata []FileMetadata
-	if err := json.Unmarshal(data, &metadata); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal metadata: %v", err)
+	merged := *local
+	merged.SchemaVersion = MetadataSchemaVersion
+	merged.Apps = make(map[string]AppMetadata)
+	for name, app := range local.Apps {
+		merged.Apps[name] = app
+	}
+	changed := make(map[string]bool, len(apps))
+	for _, name := range apps {
+		changed[name] = true
+	}
+	for name, app := range remote.Apps {
+		if !changed[name] {
+			merged.Apps[name] = app
+		}
+	}
+
+	data, err := json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata: %v", err)
+	}
+	return data, nil
+}
+
+// isKept reports whether path is one of kept or inside one of them
+func isKept(path string, kept []string) bool {
+	for _, k := range kept {
+		if path == k || strings.HasPrefix(path, k+string(filepath.Separator)) {
+			return true
+		}
 	}
+	return false
+}
 
+// LoadMetadata loads the metadata file from the backup directory. Files in
+// the legacy format are converted, grouping entries into apps by the first
+// element of their path. If the file doesn't exist, the returned error
+// satisfies os.IsNotExist.
+func LoadMetadata(backupRoot string) (*Metadata, error) {
+	metadataPath := filepath.Join(backupRoot, MetadataFileName)
+	data, err := os.ReadFile(metadataPath)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := parseMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", metadataPath, err)
+	}
 	return metadata, nil
 }
 
-// getXattrs gets extended attributes for a file (platform-specific)
-func getXattrs(path string) ([]Xattr, error) {
-	// This is a basic implementation that works on Unix-like systems
-	// For a complete implementation, you might want to use a library like github.com/pkg/xattr
-	return []Xattr{}, nil
+func parseMetadata(data []byte) (*Metadata, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var files []FileMetadata
+		if err := json.Unmarshal(trimmed, &files); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal metadata: %v", err)
+		}
+		metadata := &Metadata{SchemaVersion: 1, Apps: make(map[string]AppMetadata)}
+		for _, file := range files {
+			name := strings.SplitN(filepath.ToSlash(file.Path), "/", 2)[0]
+			app := metadata.Apps[name]
+			app.Files = append(app.Files, file)
+			metadata.Apps[name] = app
+		}
+		return metadata, nil
+	}
+
+	var metadata Metadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata: %v", err)
+	}
+	if metadata.SchemaVersion > MetadataSchemaVersion {
+		return nil, fmt.Errorf("metadata schema version %d is newer than this gitbak supports (%d), please upgrade", metadata.SchemaVersion, MetadataSchemaVersion)
+	}
+	return &metadata, nil
 }
@@ -0,0 +1,373 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kennyparsons/gitbak/config"
+	"github.com/kennyparsons/gitbak/internal/crypt"
+	"github.com/kennyparsons/gitbak/internal/redact"
+	"github.com/kennyparsons/gitbak/internal/utils"
+)
+
+// A backup runs as a pipeline: a bounded number of apps run their pre-backup
+// script and walk their paths at the same time, filtering out ignored and
+// missing entries and creating directories as they go. Every file they find
+// is queued as a fileTask for a pool of copy workers, which compare, copy and
+// record metadata for it. Files of all apps share the same workers, so one
+// huge app doesn't hold up the others.
+
+// appRun tracks a single app through a backup run
+type appRun struct {
+	name     string
+	cfg      config.AppConfig
+	dstRoot  string
+	symlinks string     // how symlinks are handled, one of config.Symlinks*
+	key      *crypt.Key // encrypts the app's files, nil unless encrypt is set
+	redact   []redact.Rule
+
+	// Every path written under dstRoot during this run, plus the backups of
+	// sources that are missing on this machine; anything else found there
+	// afterwards is stale. Only touched by the app's walker.
+	produced map[string]bool
+	kept     map[string]bool
+	// The pre-backup script failed, so nothing was backed up
+	skipped bool
+
+	mu       sync.Mutex // guards the fields below
+	result   AppResult
+	metadata []FileMetadata
+	failed   bool // some file failed, so stale files are not pruned
+}
+
+// fileTask is a file found by a walker, waiting to be copied
+type fileTask struct {
+	app *appRun
+	e   entry
+}
+
+// backupRun carries the state shared by all stages of a backup
+type backupRun struct {
+	cfg       *config.Config
+	opts      Options
+	overrides []utils.PathOverride
+	// Checksums recorded by the last backup, by path relative to backup_dir
+	previous map[string]string
+	tasks    chan fileTask
+
+	mu   sync.Mutex
+	errs []error
+	// Values taken out of redacted files, by name, and the file each came from
+	secrets       map[string]string
+	secretSources map[string]string
+}
+
+// fail records an error in app
+func (b *backupRun) fail(app *appRun, err error) {
+	app.mu.Lock()
+	app.failed = true
+	app.mu.Unlock()
+	b.mu.Lock()
+	b.errs = append(b.errs, err)
+	b.mu.Unlock()
+}
+
+// walkApp runs the app's pre-backup script and walks its paths, queueing
+// every file for the copy workers. It stops early if ctx is cancelled.
+func (b *backupRun) walkApp(ctx context.Context, app *appRun) {
+	if ctx.Err() != nil {
+		return
+	}
+	fmt.Printf("Processing custom app: %s\n", app.name)
+
+	// Execute pre-backup script if defined
+	if app.cfg.PreBackupScript != "" {
+		scriptPath := utils.ExpandPath(app.cfg.PreBackupScript, b.overrides)
+		fmt.Printf("  %s: Running pre-backup script: %s\n", app.name, scriptPath)
+		if !b.opts.DryRun {
+			if err := runPreBackupScript(ctx, app.name, scriptPath); err != nil {
+				app.skipped = true
+				b.fail(app, fmt.Errorf("%s: pre-backup script failed: %v", app.name, err))
+				return
+			}
+		}
+	}
+
+	for _, rawPath := range app.cfg.Paths {
+		srcPath := utils.ExpandPath(rawPath, b.overrides)
+		dstPath := filepath.Join(app.dstRoot, filepath.Base(srcPath))
+
+		err := walkAppPath(srcPath, dstPath, b.cfg.GlobalIgnores, app.symlinks, func(e entry) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			switch {
+			case e.info == nil:
+				// Keep whatever was backed up before rather than treating a
+				// missing source as a deletion
+				fmt.Printf("  %s: Skipped %s (does not exist)\n", app.name, e.src)
+				app.kept[e.dst] = true
+				app.kept[e.dst+TemplateSuffix] = true
+				return nil
+
+			case e.ignored != "" && e.rel == ".":
+				fmt.Printf("  %s: Ignored %s (matched global ignore pattern \"%s\")\n", app.name, e.src, e.ignored)
+				return nil
+
+			case e.ignored != "":
+				if e.info.IsDir() {
+					fmt.Printf("  %s: Ignored directory %s (globally ignored with \"%s\")\n", app.name, e.rel, e.ignored)
+				} else {
+					fmt.Printf("  %s: Ignored file %s (globally ignored with \"%s\")\n", app.name, e.rel, e.ignored)
+				}
+				return nil
+
+			case e.skipped != "":
+				if e.dangling && app.symlinks == config.SymlinksFollow {
+					// Like a missing source, keep whatever was backed up
+					// from it before
+					app.kept[e.dst] = true
+				}
+				fmt.Printf("  %s: Skipped symlink %s → %s (%s)\n", app.name, e.src, e.link, e.skipped)
+				return nil
+			}
+
+			if tmpl := templateFor(e); tmpl != "" {
+				fmt.Printf("  %s: Skipped %s (restored from template %s)\n", app.name, e.src, tmpl)
+				app.produced[tmpl] = true
+				return b.recordTemplate(app, e, tmpl)
+			}
+
+			app.produced[e.dst] = true
+
+			if e.isLink() {
+				if e.dangling {
+					fmt.Printf("  %s: Warning: dangling symlink %s → %s\n", app.name, e.src, e.link)
+				}
+				return b.copyLink(app, e)
+			}
+
+			if !e.info.IsDir() {
+				select {
+				case b.tasks <- fileTask{app: app, e: e}:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+			// Directories are created right away, before the workers copy
+			// anything into them
+			if meta, ok := b.collectMetadata(app, e); ok {
+				app.mu.Lock()
+				app.metadata = append(app.metadata, meta)
+				app.mu.Unlock()
+			}
+			if b.opts.DryRun && e.rel == "." {
+				fmt.Printf("[dry-run] CopyDir %s → %s\n", e.src, e.dst)
+			}
+			return copyDirEntry(e.info, e.dst, b.opts.DryRun)
+		})
+		if err != nil {
+			b.fail(app, fmt.Errorf("%s: copying %s: %v", app.name, srcPath, err))
+		}
+	}
+}
+
+// runPreBackupScript runs an app's pre-backup script, echoing its output.
+// The script runs in its own process group, which is killed as a whole if ctx
+// is cancelled, so no stray children outlive gitbak.
+func runPreBackupScript(ctx context.Context, appName, scriptPath string) error {
+	cmd := exec.CommandContext(ctx, "bash", "-c", scriptPath)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Don't wait forever on children that somehow kept the output pipes open
+	cmd.WaitDelay = 5 * time.Second
+	var stdoutBuf, stderrBuf bytes.Buffer
+	cmd.Stdout = &stdoutBuf
+	cmd.Stderr = &stderrBuf
+	cmdErr := cmd.Run() // Store the error
+
+	// Print stdout
+	if stdout := stdoutBuf.String(); stdout != "" {
+		for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+			fmt.Printf("  %s: Pre-backup script stdout: %s\n", appName, line)
+		}
+	}
+	// Print stderr
+	if stderr := stderrBuf.String(); stderr != "" {
+		for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+			fmt.Printf("  %s: Pre-backup script stderr: %s\n", appName, line)
+		}
+	}
+	return cmdErr
+}
+
+// copyFiles is a copy worker. It processes queued files until the queue is
+// closed. Once ctx is cancelled, the rest of the queue is drained without
+// copying anything.
+func (b *backupRun) copyFiles(ctx context.Context) {
+	for t := range b.tasks {
+		if ctx.Err() != nil {
+			continue
+		}
+		if err := b.copyTask(t); err != nil {
+			b.fail(t.app, fmt.Errorf("%s: copying %s: %v", t.app.name, t.e.src, err))
+		}
+	}
+}
+
+// copyTask copies a single file if it changed since the last backup and
+// records the outcome and metadata in its app
+func (b *backupRun) copyTask(t fileTask) error {
+	app, e := t.app, t.e
+	dryRun := b.opts.DryRun
+
+	var change Change
+	var secrets map[string]string
+	if rules := redact.ForFile(app.redact, e.src); len(rules) > 0 {
+		content, values, err := redactedCopy(e.src, rules, app.key)
+		if err != nil {
+			return err
+		}
+		if err := b.recordSecrets(values, e.src); err != nil {
+			return err
+		}
+		secrets = values
+		if change, err = compareContent(e.dst, content); err != nil {
+			return err
+		}
+		if change != Unchanged {
+			if err := writeCopy(e.src, e.dst, content, dryRun); err != nil {
+				return err
+			}
+		}
+	} else {
+		var err error
+		if change, err = compareFile(e.src, e.dst, b.opts.Checksum, app.key); err != nil {
+			return err
+		}
+		if change != Unchanged {
+			if err := copyFile(e.src, e.dst, app.key, dryRun); err != nil {
+				return err
+			}
+		}
+	}
+
+	if change == Unchanged && !dryRun {
+		// Same content but touched since the last backup; catch up the
+		// copy's mtime so the next run can take the fast path again
+		if dstInfo, err := os.Stat(e.dst); err == nil && !dstInfo.ModTime().Equal(e.info.ModTime()) {
+			if err := os.Chtimes(e.dst, time.Now(), e.info.ModTime()); err != nil {
+				return fmt.Errorf("failed to preserve modification time: %v", err)
+			}
+		}
+	}
+
+	meta, haveMeta := b.collectMetadata(app, e)
+	if haveMeta {
+		meta.Secrets = redact.Names(secrets)
+		// Checksum the copy itself, which is what verify checks later on
+		if change == Unchanged && b.previous[meta.Path] != "" {
+			meta.SHA256 = b.previous[meta.Path]
+		} else if !dryRun {
+			var err error
+			if meta.SHA256, err = FileChecksum(e.dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	relPath, _ := filepath.Rel(app.dstRoot, e.dst)
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.result.record(change, relPath)
+	if haveMeta {
+		app.metadata = append(app.metadata, meta)
+	}
+	return nil
+}
+
+// recordSecrets adds the values taken out of the file at src to the ones
+// saved after the backup. Every name must stand for a single value, or
+// restore couldn't tell which one belongs where.
+func (b *backupRun) recordSecrets(values map[string]string, src string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, value := range values {
+		if existing, ok := b.secrets[name]; ok && existing != value {
+			return fmt.Errorf("secret %s has a different value in %s; give the redact rules for these files different names", name, b.secretSources[name])
+		}
+		b.secrets[name] = value
+		b.secretSources[name] = src
+	}
+	return nil
+}
+
+// copyLink stores a preserved symlink in the backup tree and records the
+// outcome and metadata in its app
+func (b *backupRun) copyLink(app *appRun, e entry) error {
+	change, err := copySymlink(e.link, e.dst, b.opts.DryRun)
+	if err != nil {
+		return err
+	}
+	meta, haveMeta := b.collectMetadata(app, e)
+
+	relPath, _ := filepath.Rel(app.dstRoot, e.dst)
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.result.record(change, relPath)
+	if haveMeta {
+		app.metadata = append(app.metadata, meta)
+	}
+	return nil
+}
+
+// recordTemplate records the metadata of a live file that is rendered from
+// the template tmpl, under the template's path
+func (b *backupRun) recordTemplate(app *appRun, e entry, tmpl string) error {
+	meta, haveMeta := b.collectMetadata(app, e)
+	if haveMeta {
+		meta.Path, _ = filepath.Rel(b.cfg.BackupDir, tmpl)
+		meta.Template = true
+		var err error
+		if meta.SHA256, err = FileChecksum(tmpl); err != nil {
+			return err
+		}
+	}
+
+	relPath, _ := filepath.Rel(app.dstRoot, tmpl)
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.result.record(Unchanged, relPath)
+	if haveMeta {
+		app.metadata = append(app.metadata, meta)
+	}
+	return nil
+}
+
+// collectMetadata records the metadata of a walked entry, keyed by its path
+// relative to backup_dir. Failures are reported but don't fail the backup.
+func (b *backupRun) collectMetadata(app *appRun, e entry) (FileMetadata, bool) {
+	meta, err := CollectFileMetadata(e.src, e.info)
+	if err != nil {
+		fmt.Printf("  %s: Failed to collect metadata for %s: %v\n", app.name, e.src, err)
+		return FileMetadata{}, false
+	}
+	meta.Path, _ = filepath.Rel(b.cfg.BackupDir, e.dst)
+	if e.isLink() {
+		meta.Link = e.link
+	}
+	return meta, true
+}
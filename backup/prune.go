@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// findStale walks dstRoot and returns the files and directories that were
+// not produced by a backup run, so deletions in the live config can be
+// carried over into the backup tree. Paths in kept are skipped along with
+// everything beneath them, as are paths matching globalIgnores. Directories
+// are returned deepest first.
+func findStale(dstRoot string, produced, kept map[string]bool, globalIgnores []string) (files, dirs []string, err error) {
+	if _, err := os.Lstat(dstRoot); os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+
+	err = filepath.Walk(dstRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dstRoot {
+			return nil
+		}
+		if kept[path] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		ignore, _, err := shouldIgnore(path, globalIgnores)
+		if err != nil {
+			return fmt.Errorf("error checking ignore for %s: %v", path, err)
+		}
+		if ignore {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if produced[path] {
+			return nil
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+		} else {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	return files, dirs, nil
+}
+
+// pruneStale removes everything findStale reports under dstRoot and returns
+// the removed files relative to dstRoot
+func pruneStale(appName, dstRoot string, produced, kept map[string]bool, globalIgnores []string, dryRun bool) ([]string, error) {
+	files, dirs, err := findStale(dstRoot, produced, kept, globalIgnores)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, path := range files {
+		relPath, _ := filepath.Rel(dstRoot, path)
+		if dryRun {
+			fmt.Printf("[dry-run] Remove stale %s\n", path)
+			removed = append(removed, relPath)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+		fmt.Printf("  %s: Removed stale %s\n", appName, relPath)
+		removed = append(removed, relPath)
+	}
+
+	// A stale directory that still holds ignored files is not empty and is
+	// left in place
+	for _, dir := range dirs {
+		relPath, _ := filepath.Rel(dstRoot, dir)
+		if dryRun {
+			fmt.Printf("[dry-run] Remove stale directory %s\n", dir)
+			continue
+		}
+		if err := os.Remove(dir); err != nil {
+			if entries, readErr := os.ReadDir(dir); readErr == nil && len(entries) > 0 {
+				continue
+			}
+			return removed, fmt.Errorf("failed to remove %s: %v", dir, err)
+		}
+		fmt.Printf("  %s: Removed stale directory %s\n", appName, relPath)
+	}
+	return removed, nil
+}
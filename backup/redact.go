@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kennyparsons/gitbak/internal/crypt"
+	"github.com/kennyparsons/gitbak/internal/redact"
+	"github.com/kennyparsons/gitbak/internal/utils"
+)
+
+// redactedCopy returns what the backup copy of src holds when some of the
+// app's redact rules apply to it: its contents with the secret values
+// replaced by placeholders, encrypted if key is not nil. It also returns the
+// values that were taken out, by name.
+func redactedCopy(src string, rules []redact.Rule, key *crypt.Key) ([]byte, map[string]string, error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read source file: %v", err)
+	}
+	data, values, err := redact.Apply(data, src, rules)
+	if err != nil {
+		return nil, nil, err
+	}
+	if key != nil {
+		data = key.Encrypt(data)
+	}
+	return data, values, nil
+}
+
+// compareContent reports whether the backup copy dst is missing or differs
+// from content. Redacted copies never match their source in size, so they are
+// always compared in full.
+func compareContent(dst string, content []byte) (Change, error) {
+	dstInfo, err := os.Lstat(dst)
+	if os.IsNotExist(err) {
+		return Added, nil
+	} else if err != nil {
+		return Unchanged, err
+	}
+	if !dstInfo.Mode().IsRegular() || dstInfo.Size() != int64(len(content)) {
+		return Modified, nil
+	}
+	existing, err := os.ReadFile(dst)
+	if err != nil {
+		return Unchanged, err
+	}
+	if !bytes.Equal(existing, content) {
+		return Modified, nil
+	}
+	return Unchanged, nil
+}
+
+// writeCopy replaces the backup copy dst with content, keeping the
+// permissions and modification time of the source file
+func writeCopy(src, dst string, content []byte, dryRun bool) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to stat source file: %v", err)
+	}
+	if dryRun {
+		fmt.Printf("[dry-run] CopyFile %s → %s (redacted)\n", src, dst)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %v", err)
+	}
+	if err := utils.WriteFileAtomic(dst, bytes.NewReader(content), srcInfo.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to copy file contents: %v", err)
+	}
+	if err := os.Chtimes(dst, time.Now(), srcInfo.ModTime()); err != nil {
+		return fmt.Errorf("failed to preserve modification time: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"sort"
+)
+
+// AppResult lists the files a backup run changed for a single app. Paths are
+// relative to backup_dir/<app>.
+type AppResult struct {
+	Name     string
+	Added    []string
+	Modified []string
+	Deleted  []string
+	// Unchanged counts files that were already up to date
+	Unchanged int
+}
+
+// Changed reports whether the backup changed any file of the app
+func (a AppResult) Changed() bool {
+	return len(a.Added)+len(a.Modified)+len(a.Deleted) > 0
+}
+
+// record counts a file with the given change
+func (a *AppResult) record(change Change, relPath string) {
+	switch change {
+	case Added:
+		a.Added = append(a.Added, relPath)
+	case Modified:
+		a.Modified = append(a.Modified, relPath)
+	default:
+		a.Unchanged++
+	}
+}
+
+// Result summarizes a backup run, one entry per processed app sorted by name
+type Result struct {
+	Apps []AppResult
+}
+
+// ChangedApps returns the apps that had at least one file added, modified or
+// deleted
+func (r *Result) ChangedApps() []AppResult {
+	var changed []AppResult
+	for _, app := range r.Apps {
+		if app.Changed() {
+			changed = append(changed, app)
+		}
+	}
+	return changed
+}
+
+func (r *Result) sort() {
+	sort.Slice(r.Apps, func(i, j int) bool { return r.Apps[i].Name < r.Apps[j].Name })
+	for i := range r.Apps {
+		sort.Strings(r.Apps[i].Added)
+		sort.Strings(r.Apps[i].Modified)
+		sort.Strings(r.Apps[i].Deleted)
+	}
+}
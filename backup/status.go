@@ -0,0 +1,309 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kennyparsons/gitbak/config"
+	"github.com/kennyparsons/gitbak/internal/crypt"
+	"github.com/kennyparsons/gitbak/internal/redact"
+	"github.com/kennyparsons/gitbak/internal/utils"
+)
+
+// Change describes how a live file differs from its copy in the backup
+type Change int
+
+const (
+	Unchanged Change = iota
+	Added
+	Modified
+	Deleted
+)
+
+func (c Change) String() string {
+	switch c {
+	case Added:
+		return "new"
+	case Modified:
+		return "modified"
+	case Deleted:
+		return "deleted"
+	default:
+		return "unchanged"
+	}
+}
+
+// FileStatus is the state of a single file in an app's backup
+type FileStatus struct {
+	Path   string // Relative path from backup_dir/<app>
+	Src    string // Live path (where a deleted file used to be)
+	Dst    string // Path inside backup_dir
+	Change Change
+	Link   bool // The live file is a symlink stored as a link
+}
+
+// AppStatus holds the status of every file a backup of an app would produce
+type AppStatus struct {
+	Name  string
+	Files []FileStatus
+}
+
+// Drifted reports whether any file in the app differs from the backup
+func (a AppStatus) Drifted() bool {
+	for _, f := range a.Files {
+		if f.Change != Unchanged {
+			return true
+		}
+	}
+	return false
+}
+
+// Scan compares the live files of every custom app against backup_dir without
+// copying anything. It walks the app paths exactly like PerformBackup, so
+// global ignores and path overrides give the same answer a real backup would.
+// If appName is not empty, only that app is scanned.
+func Scan(cfg *config.Config, appName string, overrides []utils.PathOverride) ([]AppStatus, error) {
+	var names []string
+	for name := range cfg.CustomApps {
+		if appName != "" && name != appName {
+			continue
+		}
+		names = append(names, name)
+	}
+	if appName != "" && len(names) == 0 {
+		return nil, fmt.Errorf("app %s not found in config", appName)
+	}
+	sort.Strings(names)
+
+	var statuses []AppStatus
+	var key *crypt.Key
+	for _, name := range names {
+		appCfg := cfg.CustomApps[name]
+		var appKey *crypt.Key
+		if appCfg.Encrypt {
+			if key == nil {
+				var err error
+				if key, err = encryptionKey(cfg, true); err != nil {
+					return nil, err
+				}
+			}
+			appKey = key
+		}
+		status, err := scanApp(cfg, name, appCfg, appKey, overrides)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func scanApp(cfg *config.Config, appName string, appCfg config.AppConfig, key *crypt.Key, overrides []utils.PathOverride) (AppStatus, error) {
+	status := AppStatus{Name: appName}
+	dstRoot := filepath.Join(cfg.BackupDir, appName)
+	produced := make(map[string]bool)
+	kept := make(map[string]bool)
+	roots := make(map[string]string) // backup path → live path of each app path
+	symlinks, err := cfg.SymlinkMode(appCfg)
+	if err != nil {
+		return status, err
+	}
+	rules, err := redact.Compile(appCfg.Redact)
+	if err != nil {
+		return status, err
+	}
+
+	for _, rawPath := range appCfg.Paths {
+		srcPath := utils.ExpandPath(rawPath, overrides)
+		dstPath := filepath.Join(dstRoot, filepath.Base(srcPath))
+		roots[dstPath] = srcPath
+
+		err := walkAppPath(srcPath, dstPath, cfg.GlobalIgnores, symlinks, func(e entry) error {
+			if e.info == nil {
+				kept[e.dst] = true
+				kept[e.dst+TemplateSuffix] = true
+				return nil
+			}
+			if e.skipped != "" && e.dangling && symlinks == config.SymlinksFollow {
+				kept[e.dst] = true
+				return nil
+			}
+			if e.ignored != "" || e.skipped != "" {
+				return nil
+			}
+			// Templates change only when edited in backup_dir
+			if tmpl := templateFor(e); tmpl != "" {
+				produced[tmpl] = true
+				relPath, _ := filepath.Rel(dstRoot, tmpl)
+				status.Files = append(status.Files, FileStatus{Path: relPath, Src: e.src, Dst: tmpl, Change: Unchanged})
+				return nil
+			}
+			produced[e.dst] = true
+			if e.info.IsDir() {
+				return nil
+			}
+
+			var change Change
+			if e.isLink() {
+				change = compareLink(e.link, e.dst)
+			} else if fileRules := redact.ForFile(rules, e.src); len(fileRules) > 0 {
+				content, _, err := redactedCopy(e.src, fileRules, key)
+				if err != nil {
+					return err
+				}
+				if change, err = compareContent(e.dst, content); err != nil {
+					return err
+				}
+			} else {
+				var err error
+				if change, err = compareFile(e.src, e.dst, true, key); err != nil {
+					return err
+				}
+			}
+			relPath, _ := filepath.Rel(dstRoot, e.dst)
+			status.Files = append(status.Files, FileStatus{Path: relPath, Src: e.src, Dst: e.dst, Change: change, Link: e.isLink()})
+			return nil
+		})
+		if err != nil {
+			return status, fmt.Errorf("scanning %s: %v", srcPath, err)
+		}
+	}
+
+	stale, _, err := findStale(dstRoot, produced, kept, cfg.GlobalIgnores)
+	if err != nil {
+		return status, err
+	}
+	for _, path := range stale {
+		relPath, _ := filepath.Rel(dstRoot, path)
+		status.Files = append(status.Files, FileStatus{Path: relPath, Src: livePath(path, roots), Dst: path, Change: Deleted})
+	}
+
+	sort.Slice(status.Files, func(i, j int) bool { return status.Files[i].Path < status.Files[j].Path })
+	return status, nil
+}
+
+// livePath maps a path inside the backup back to the live location it was
+// copied from, or returns an empty string if no app path covers it
+func livePath(dst string, roots map[string]string) string {
+	for dstRoot, srcRoot := range roots {
+		if dst == dstRoot {
+			return srcRoot
+		}
+		if rel, err := filepath.Rel(dstRoot, dst); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.Join(srcRoot, rel)
+		}
+	}
+	return ""
+}
+
+// compareFile reports whether the backup copy dst is missing or differs in
+// content from the live file src. Backups preserve modification times, so
+// unless checksum is set, a copy with the same size and mtime as its source
+// is taken to be unchanged without reading either file. If key is not nil,
+// dst is an encrypted copy.
+func compareFile(src, dst string, checksum bool, key *crypt.Key) (Change, error) {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return Unchanged, err
+	}
+	dstInfo, err := os.Lstat(dst)
+	if os.IsNotExist(err) {
+		return Added, nil
+	} else if err != nil {
+		return Unchanged, err
+	}
+	size := srcInfo.Size()
+	if key != nil {
+		size += int64(crypt.Overhead)
+	}
+	if !dstInfo.Mode().IsRegular() || size != dstInfo.Size() {
+		return Modified, nil
+	}
+	if !checksum && srcInfo.ModTime().Equal(dstInfo.ModTime()) {
+		return Unchanged, nil
+	}
+
+	var same bool
+	if key != nil {
+		same, err = sameDecrypted(src, dst, key)
+	} else {
+		same, err = sameContent(src, dst)
+	}
+	if err != nil {
+		return Unchanged, err
+	}
+	if !same {
+		return Modified, nil
+	}
+	return Unchanged, nil
+}
+
+// compareLink reports whether the backup tree has a symlink to target at dst
+func compareLink(target, dst string) Change {
+	existing, err := os.Readlink(dst)
+	switch {
+	case err == nil && existing == target:
+		return Unchanged
+	case os.IsNotExist(err):
+		return Added
+	default:
+		return Modified
+	}
+}
+
+// sameDecrypted compares the file plain with the encrypted file sealed. A
+// copy that can't be decrypted with key is reported as different, so it gets
+// encrypted again.
+func sameDecrypted(plain, sealed string, key *crypt.Key) (bool, error) {
+	data, err := os.ReadFile(sealed)
+	if err != nil {
+		return false, err
+	}
+	decrypted, err := key.Decrypt(data)
+	if err != nil {
+		return false, nil
+	}
+	live, err := os.ReadFile(plain)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(live, decrypted), nil
+}
+
+// sameContent compares two files byte by byte
+func sameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA := make([]byte, 32*1024)
+	bufB := make([]byte, 32*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package backup
+
+import (
+	"os"
+)
+
+// A file in backup_dir can be replaced by a template written by hand, named
+// after the backup copy plus TemplateSuffix, e.g. git/.gitconfig.tmpl. The
+// live file is then rendered from the template on restore and never copied
+// over it, so the template only changes when it is edited in backup_dir.
+
+// TemplateSuffix marks a file in backup_dir as a template for the live file
+// without the suffix
+const TemplateSuffix = ".tmpl"
+
+// templateFor returns the template the live file of e is restored from, or an
+// empty string if it has none. A live file that itself ends in TemplateSuffix
+// next to e.src is backed up as is, so its copy isn't taken for a template.
+func templateFor(e entry) string {
+	if e.info == nil || !e.info.Mode().IsRegular() {
+		return ""
+	}
+	tmpl := e.dst + TemplateSuffix
+	if info, err := os.Lstat(tmpl); err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	if _, err := os.Lstat(e.src + TemplateSuffix); err == nil {
+		return ""
+	}
+	return tmpl
+}
@@ -0,0 +1,108 @@
+//go:build linux
+
+package backup
+
+import (
+	"bytes"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// xattrNamespaces are the extended attribute namespaces that are backed up.
+// trusted.* and system.* (ACLs) are left out: the first needs root to even
+// read, the second is better served by the file mode.
+var xattrNamespaces = []string{"user.", "security."}
+
+// getXattrs gets the user.* and security.* extended attributes of a file,
+// with values base64-encoded. Attributes that can't be read are skipped.
+func getXattrs(path string) ([]Xattr, error) {
+	names, err := listXattrs(path)
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			// Filesystem without xattr support
+			return []Xattr{}, nil
+		}
+		return nil, err
+	}
+
+	xattrs := []Xattr{}
+	for _, name := range names {
+		if !backedUpXattr(name) {
+			continue
+		}
+		value, err := readXattr(path, name)
+		if err != nil {
+			if err == syscall.EPERM || err == syscall.EACCES || err == syscall.ENODATA {
+				continue
+			}
+			return nil, err
+		}
+		xattrs = append(xattrs, Xattr{Name: name, Value: base64.StdEncoding.EncodeToString(value)})
+	}
+
+	// Keep the metadata file stable between runs
+	sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].Name < xattrs[j].Name })
+	return xattrs, nil
+}
+
+func backedUpXattr(name string) bool {
+	for _, ns := range xattrNamespaces {
+		if strings.HasPrefix(name, ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// listXattrs returns the names of all extended attributes of path
+func listXattrs(path string) ([]string, error) {
+	for {
+		size, err := syscall.Listxattr(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		size, err = syscall.Listxattr(path, buf)
+		if err == syscall.ERANGE {
+			continue // Attributes were added in between; try again
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for _, name := range bytes.Split(buf[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// readXattr returns the raw value of a single extended attribute
+func readXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return []byte{}, nil
+		}
+		buf := make([]byte, size)
+		size, err = syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			continue // Value grew in between; try again
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
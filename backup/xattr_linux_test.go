@@ -0,0 +1,33 @@
+//go:build linux
+
+package backup
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestGetXattrs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	value := []byte{0, 1, 2, 0xff}
+	if err := syscall.Setxattr(path, "user.gitbak.test", value, 0); err != nil {
+		t.Skipf("user xattrs not supported here: %v", err)
+	}
+
+	xattrs, err := getXattrs(path)
+	if err != nil {
+		t.Fatalf("getXattrs() error = %v", err)
+	}
+	if len(xattrs) != 1 || xattrs[0].Name != "user.gitbak.test" {
+		t.Fatalf("getXattrs() = %v, want user.gitbak.test", xattrs)
+	}
+	if got, _ := base64.StdEncoding.DecodeString(xattrs[0].Value); string(got) != string(value) {
+		t.Errorf("value = %v, want %v", got, value)
+	}
+}
@@ -2,20 +2,217 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kennyparsons/gitbak/internal/utils"
 )
 
 // Config represents the structure of gitbak.json
 type AppConfig struct {
 	Paths           []string `json:"paths"`
 	PreBackupScript string   `json:"pre_backup_script,omitempty"`
+	// Symlinks overrides the global symlinks setting for this app
+	Symlinks string `json:"symlinks,omitempty"`
+	// Encrypt stores the app's files encrypted in backup_dir
+	Encrypt bool `json:"encrypt,omitempty"`
+	// Redact replaces secret values in the app's files with placeholders
+	Redact []RedactRule `json:"redact,omitempty"`
+}
+
+// RedactRule picks out secret values in some of an app's files, by regex or
+// by key path, to keep them out of backup_dir
+type RedactRule struct {
+	// Name identifies the value in the secrets file and the environment
+	Name string `json:"name"`
+	// Files is a glob for the files the rule applies to, matched like
+	// global_ignores
+	Files string `json:"files"`
+	// Pattern is a regex matching the value, or text around it with the
+	// value in the first group
+	Pattern string `json:"pattern,omitempty"`
+	// Key is a key path like "auths.*.auth" in a JSON, YAML or INI file
+	Key string `json:"key,omitempty"`
 }
 
 type Config struct {
-	BackupDir    string                `json:"backup_dir"`
-	CustomApps   map[string]AppConfig `json:"custom_apps"`
+	BackupDir     string               `json:"backup_dir"`
+	CustomApps    map[string]AppConfig `json:"custom_apps"`
 	GlobalIgnores []string             `json:"global_ignores,omitempty"`
+	// OnConflict is the default restore conflict policy (ask, skip, overwrite, backup, newer, fail)
+	OnConflict string `json:"on_conflict,omitempty"`
+	// CommitMessageTemplate is a text/template for backup commit messages
+	CommitMessageTemplate string `json:"commit_message_template,omitempty"`
+	// CommitMode is "single" (default) or "per-app"
+	CommitMode string `json:"commit_mode,omitempty"`
+	// SyncStrategy is "push" (default), "rebase", "fetch-check" or "host-branch"
+	SyncStrategy string `json:"sync_strategy,omitempty"`
+	// HostLayout namespaces backups by machine: "directory" or "branch"
+	HostLayout string `json:"host_layout,omitempty"`
+	// HostName overrides the detected name of this machine
+	HostName string `json:"host_name,omitempty"`
+	// Symlinks is "follow" (default), "preserve" or "skip"
+	Symlinks string `json:"symlinks,omitempty"`
+	// EncryptionKeyFile holds the passphrase for apps with encrypt set
+	EncryptionKeyFile string `json:"encryption_key_file,omitempty"`
+	// SecretPatterns are regexes for secrets, checked before every commit on
+	// top of the built-in rules
+	SecretPatterns []string `json:"secret_patterns,omitempty"`
+	// SecretsFile is where redacted values are kept on this machine
+	SecretsFile string `json:"secrets_file,omitempty"`
+	// Vars are variables for the templates in backup_dir
+	Vars map[string]string `json:"vars,omitempty"`
+	// HostVars override Vars on the machines they are keyed by
+	HostVars map[string]map[string]string `json:"host_vars,omitempty"`
+	// Profiles are named sets of path overrides, selected with --profile or
+	// by host name
+	Profiles map[string]Profile `json:"profiles,omitempty"`
+
+	// Profile is the name of the profile in use, set by UseProfile
+	Profile string `json:"-"`
+}
+
+// Profile is a named set of path overrides and template variables, e.g. for
+// moving configs between /Users/me on a Mac and /home/me on Linux
+type Profile struct {
+	// PathOverrides are "regex=replacement" overrides, applied in order
+	PathOverrides []string `json:"path_overrides,omitempty"`
+	// Vars override the vars and host_vars for templates
+	Vars map[string]string `json:"vars,omitempty"`
+	// Hosts are host names, or shell patterns like "work-*", of the machines
+	// the profile is used on unless --profile says otherwise
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// Host layouts for host_layout in gitbak.json
+const (
+	// HostLayoutDirectory stores backups in backup_dir/<host>/<app>
+	HostLayoutDirectory = "directory"
+	// HostLayoutBranch commits backups to a branch named after the host
+	HostLayoutBranch = "branch"
+)
+
+// Symlink handling for symlinks in gitbak.json
+const (
+	// SymlinksFollow backs up the files and directories symlinks point to
+	SymlinksFollow = "follow"
+	// SymlinksPreserve stores symlinks as links and recreates them on restore
+	SymlinksPreserve = "preserve"
+	// SymlinksSkip leaves symlinks out of the backup
+	SymlinksSkip = "skip"
+)
+
+// SymlinkMode returns how the symlinks of app are backed up: the app's own
+// setting if it has one, else the global one, else SymlinksFollow
+func (c *Config) SymlinkMode(app AppConfig) (string, error) {
+	mode := c.Symlinks
+	if app.Symlinks != "" {
+		mode = app.Symlinks
+	}
+	switch mode {
+	case "":
+		return SymlinksFollow, nil
+	case SymlinksFollow, SymlinksPreserve, SymlinksSkip:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid symlinks setting %q, must be %q, %q or %q", mode, SymlinksFollow, SymlinksPreserve, SymlinksSkip)
+	}
+}
+
+// Host returns the name this machine's backups are stored under
+func (c *Config) Host() string {
+	if c.HostName != "" {
+		return utils.SanitizeName(c.HostName)
+	}
+	return utils.HostName()
+}
+
+// TemplateVars returns the template variables of this machine: Vars with
+// the host_vars entry for Host and then the vars of the profile in use on top
+func (c *Config) TemplateVars() map[string]string {
+	vars := make(map[string]string)
+	for k, v := range c.Vars {
+		vars[k] = v
+	}
+	for k, v := range c.HostVars[c.Host()] {
+		vars[k] = v
+	}
+	for k, v := range c.Profiles[c.Profile].Vars {
+		vars[k] = v
+	}
+	return vars
+}
+
+// UseProfile selects the profile called name. If name is empty, the profile
+// whose hosts match Host is selected, if there is one.
+func (c *Config) UseProfile(name string) error {
+	if name != "" {
+		if _, ok := c.Profiles[name]; !ok {
+			return fmt.Errorf("profile %q not found in config", name)
+		}
+		c.Profile = name
+		return nil
+	}
+
+	host := c.Host()
+	var matched []string
+	for profileName, profile := range c.Profiles {
+		for _, pattern := range profile.Hosts {
+			if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+				matched = append(matched, profileName)
+				break
+			}
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return nil
+	case 1:
+		c.Profile = matched[0]
+		return nil
+	default:
+		sort.Strings(matched)
+		return fmt.Errorf("profiles %s all match host %s; pick one with --profile", strings.Join(matched, ", "), host)
+	}
+}
+
+// PathOverrides returns the path overrides of the profile in use followed by
+// flags, the ones given on the command line. Every matching override is
+// applied in order, so the command line gets the last word on a path both
+// rewrite.
+func (c *Config) PathOverrides(flags []utils.PathOverride) ([]utils.PathOverride, error) {
+	var overrides []utils.PathOverride
+	for _, s := range c.Profiles[c.Profile].PathOverrides {
+		o, err := utils.ParsePathOverride(s)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", c.Profile, err)
+		}
+		overrides = append(overrides, o)
+	}
+	return append(overrides, flags...), nil
+}
+
+// ApplyHostLayout points BackupDir at the backups of host when the directory
+// host layout is used. It must be called after BackupDir has been expanded.
+func (c *Config) ApplyHostLayout(host string) error {
+	switch c.HostLayout {
+	case "", HostLayoutBranch:
+		return nil
+	case HostLayoutDirectory:
+		name := utils.SanitizeName(host)
+		if err := utils.CheckHostName(name); err != nil {
+			return err
+		}
+		c.BackupDir = filepath.Join(c.BackupDir, name)
+		return nil
+	default:
+		return fmt.Errorf("invalid host_layout %q, must be %q or %q", c.HostLayout, HostLayoutDirectory, HostLayoutBranch)
+	}
 }
 
 // LoadConfig reads and parses gitbak.json into a Config struct
@@ -61,4 +258,3 @@ func (c *Config) SaveConfig(path string) error {
 
 	return os.WriteFile(path, bytes, 0644)
 }
-
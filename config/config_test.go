@@ -3,7 +3,10 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
+
+	"github.com/kennyparsons/gitbak/internal/utils"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -121,3 +124,102 @@ func TestConfig_SaveConfig(t *testing.T) {
 		t.Error("reloaded config is missing 'testapp'")
 	}
 }
+
+func TestConfig_ApplyHostLayout(t *testing.T) {
+	cfg := &Config{BackupDir: "/backups"}
+	if err := cfg.ApplyHostLayout("laptop"); err != nil || cfg.BackupDir != "/backups" {
+		t.Errorf("no layout: BackupDir = %q, err = %v, want unchanged", cfg.BackupDir, err)
+	}
+
+	cfg = &Config{BackupDir: "/backups", HostLayout: HostLayoutDirectory}
+	if err := cfg.ApplyHostLayout("Work Laptop"); err != nil || cfg.BackupDir != "/backups/work-laptop" {
+		t.Errorf("directory layout: BackupDir = %q, err = %v, want /backups/work-laptop", cfg.BackupDir, err)
+	}
+
+	for _, host := range []string{"..", ".", "...", ""} {
+		cfg = &Config{BackupDir: "/backups", HostLayout: HostLayoutDirectory}
+		if err := cfg.ApplyHostLayout(host); err == nil {
+			t.Errorf("directory layout: host %q accepted, BackupDir = %q", host, cfg.BackupDir)
+		}
+	}
+
+	cfg = &Config{BackupDir: "/backups", HostLayout: HostLayoutBranch}
+	if err := cfg.ApplyHostLayout("laptop"); err != nil || cfg.BackupDir != "/backups" {
+		t.Errorf("branch layout: BackupDir = %q, err = %v, want unchanged", cfg.BackupDir, err)
+	}
+
+	cfg = &Config{BackupDir: "/backups", HostLayout: "subfolder"}
+	if err := cfg.ApplyHostLayout("laptop"); err == nil {
+		t.Error("ApplyHostLayout accepted an invalid layout")
+	}
+}
+
+func TestConfig_SymlinkMode(t *testing.T) {
+	cfg := &Config{}
+	if mode, err := cfg.SymlinkMode(AppConfig{}); err != nil || mode != SymlinksFollow {
+		t.Errorf("default: mode = %q, err = %v, want %q", mode, err, SymlinksFollow)
+	}
+
+	cfg = &Config{Symlinks: SymlinksPreserve}
+	if mode, err := cfg.SymlinkMode(AppConfig{}); err != nil || mode != SymlinksPreserve {
+		t.Errorf("global: mode = %q, err = %v, want %q", mode, err, SymlinksPreserve)
+	}
+	if mode, err := cfg.SymlinkMode(AppConfig{Symlinks: SymlinksSkip}); err != nil || mode != SymlinksSkip {
+		t.Errorf("per app: mode = %q, err = %v, want %q", mode, err, SymlinksSkip)
+	}
+
+	if _, err := cfg.SymlinkMode(AppConfig{Symlinks: "copy"}); err == nil {
+		t.Error("SymlinkMode accepted an invalid setting")
+	}
+}
+
+func TestConfig_UseProfile(t *testing.T) {
+	cfg := &Config{
+		HostName: "Work-MBP",
+		Vars:     map[string]string{"email": "me@home", "editor": "nvim"},
+		HostVars: map[string]map[string]string{"work-mbp": {"email": "me@work"}},
+		Profiles: map[string]Profile{
+			"work-mac": {PathOverrides: []string{"^/home/me=/Users/me"}, Vars: map[string]string{"editor": "code"}, Hosts: []string{"work-*"}},
+			"linux":    {PathOverrides: []string{"^/Users/me=/home/me"}},
+		},
+	}
+
+	if err := cfg.UseProfile(""); err != nil || cfg.Profile != "work-mac" {
+		t.Fatalf("by host: Profile = %q, err = %v, want work-mac", cfg.Profile, err)
+	}
+	overrides, err := cfg.PathOverrides(nil)
+	if err != nil || len(overrides) != 1 || overrides[0].Replacement != "/Users/me" {
+		t.Errorf("PathOverrides() = %v, %v", overrides, err)
+	}
+
+	// A flag undoing the profile's rewrite has the last word
+	flag, err := utils.ParsePathOverride("^/Users/me=/home/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides, err = cfg.PathOverrides([]utils.PathOverride{flag})
+	if err != nil {
+		t.Fatalf("PathOverrides() error = %v", err)
+	}
+	for _, path := range []string{"/home/me/.zshrc", "/Users/me/.zshrc"} {
+		if got := utils.ApplyOverrides(path, overrides); got != "/home/me/.zshrc" {
+			t.Errorf("ApplyOverrides(%s) = %s, want the flag's /home/me/.zshrc", path, got)
+		}
+	}
+	want := map[string]string{"email": "me@work", "editor": "code"}
+	if got := cfg.TemplateVars(); !reflect.DeepEqual(got, want) {
+		t.Errorf("TemplateVars() = %v, want %v", got, want)
+	}
+
+	if err := cfg.UseProfile("linux"); err != nil || cfg.Profile != "linux" {
+		t.Errorf("by name: Profile = %q, err = %v, want linux", cfg.Profile, err)
+	}
+	if err := cfg.UseProfile("windows"); err == nil {
+		t.Error("UseProfile accepted an unknown profile")
+	}
+
+	cfg.Profiles["linux"] = Profile{Hosts: []string{"*-mbp"}}
+	if err := cfg.UseProfile(""); err == nil {
+		t.Error("UseProfile picked one of two profiles matching the host")
+	}
+}
@@ -0,0 +1,179 @@
+package diff
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kennyparsons/gitbak/backup"
+	"github.com/kennyparsons/gitbak/config"
+	"github.com/kennyparsons/gitbak/internal/crypt"
+	"github.com/kennyparsons/gitbak/internal/redact"
+	"github.com/kennyparsons/gitbak/internal/utils"
+)
+
+// Diff prints a unified diff for every file that differs between its copy in
+// the backup directory and its live location. Lines prefixed with "-" are only
+// in the backup, lines prefixed with "+" are only in the live file. Binary
+// files are reported by size and SHA-256 only.
+// If appName is not empty, only that app is compared; if path is not empty,
+// only live files at or below that path are compared.
+// It returns true if any differences were found.
+func Diff(cfg *config.Config, appName, path string, overrides []utils.PathOverride) (bool, error) {
+	statuses, err := backup.Scan(cfg, appName, overrides)
+	if err != nil {
+		return false, err
+	}
+
+	if path != "" {
+		path = utils.ExpandPath(path, overrides)
+	}
+
+	keys := &crypt.KeyLoader{Dir: cfg.BackupDir, KeyFile: cfg.EncryptionKeyFile}
+	differs := false
+	for _, app := range statuses {
+		rules, err := redact.Compile(cfg.CustomApps[app.Name].Redact)
+		if err != nil {
+			return differs, fmt.Errorf("%s: %v", app.Name, err)
+		}
+		for _, f := range app.Files {
+			if f.Change == backup.Unchanged {
+				continue
+			}
+			if path != "" && f.Src != path && !strings.HasPrefix(f.Src, path+string(filepath.Separator)) {
+				continue
+			}
+
+			backupPath, live := f.Dst, f.Src
+			switch f.Change {
+			case backup.Added:
+				backupPath = ""
+			case backup.Deleted:
+				live = ""
+			}
+
+			var out string
+			if f.Link {
+				out, err = Links(backupPath, live)
+			} else {
+				out, err = Files(backupPath, live, keys, rules)
+			}
+			if err != nil {
+				return differs, fmt.Errorf("%s: %v", f.Path, err)
+			}
+			differs = true
+			fmt.Printf("diff %s/%s (%s)\n", app.Name, f.Path, f.Change)
+			fmt.Print(out)
+		}
+	}
+
+	return differs, nil
+}
+
+// Files returns the differences between a backed-up file and a live file as a
+// unified diff, or as a size and hash summary if either is binary. An empty
+// path stands for a file that does not exist. An encrypted backup copy is
+// decrypted with a key from keys. Secrets the redact rules pick out of the
+// live file are replaced with placeholders, like in its backup copy, so they
+// never show up in the diff. A backup copy that is a preserved symlink is
+// compared with Links.
+func Files(backupPath, livePath string, keys *crypt.KeyLoader, rules []redact.Rule) (string, error) {
+	if backupPath != "" {
+		if info, err := os.Lstat(backupPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return Links(backupPath, livePath)
+		}
+	}
+
+	a, aName, err := readSide(backupPath, keys)
+	if err != nil {
+		return "", err
+	}
+	b, bName, err := readSide(livePath, nil)
+	if err != nil {
+		return "", err
+	}
+	if fileRules := redact.ForFile(rules, livePath); livePath != "" && len(fileRules) > 0 {
+		if b, _, err = redact.Apply(b, livePath, fileRules); err != nil {
+			return "", err
+		}
+	}
+
+	if IsBinary(a) || IsBinary(b) {
+		if string(a) == string(b) {
+			return "", nil
+		}
+		return fmt.Sprintf("Binary files %s and %s differ\n  size: %d → %d\n  sha256: %s → %s\n",
+			aName, bName, len(a), len(b), shortHash(a, backupPath), shortHash(b, livePath)), nil
+	}
+	return Unified(aName, bName, a, b), nil
+}
+
+// Links returns the differences between a symlink preserved in the backup and
+// the live path as a summary of their targets, or an empty string if both
+// point to the same place. Neither link is followed.
+func Links(backupPath, livePath string) (string, error) {
+	a, aName, err := linkSide(backupPath)
+	if err != nil {
+		return "", err
+	}
+	b, bName, err := linkSide(livePath)
+	if err != nil {
+		return "", err
+	}
+	if a == b {
+		return "", nil
+	}
+	return fmt.Sprintf("Symlinks %s and %s differ\n  %s\n  %s\n", aName, bName, a, b), nil
+}
+
+// linkSide describes the target of the symlink at path, or what is there
+// instead of a symlink
+func linkSide(path string) (string, string, error) {
+	if path == "" {
+		return "(none)", "/dev/null", nil
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return "(none)", path, nil
+	} else if err != nil {
+		return "", "", err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", "", err
+		}
+		return "link → " + target, path, nil
+	case info.IsDir():
+		return "(directory, not a symlink)", path, nil
+	default:
+		return "(file, not a symlink)", path, nil
+	}
+}
+
+func readSide(path string, keys *crypt.KeyLoader) ([]byte, string, error) {
+	if path == "" {
+		return nil, "/dev/null", nil
+	}
+	var data []byte
+	var err error
+	if keys != nil {
+		data, err = crypt.ReadFile(path, keys)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, path, nil
+}
+
+func shortHash(data []byte, path string) string {
+	if path == "" {
+		return "-"
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))[:12]
+}
@@ -0,0 +1,107 @@
+package diff
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kennyparsons/gitbak/config"
+	"github.com/kennyparsons/gitbak/internal/redact"
+)
+
+func TestDiffPreservedDirectoryLink(t *testing.T) {
+	root := t.TempDir()
+	live := filepath.Join(root, "live", "app")
+	backupDir := filepath.Join(root, "backup")
+	for _, dir := range []string{filepath.Join(root, "old"), filepath.Join(root, "new"), live, filepath.Join(backupDir, "app", "app")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := filepath.Join(backupDir, "app", "app", "dirlink")
+	if err := os.Symlink(filepath.Join(root, "old"), stored); err != nil {
+		t.Fatal(err)
+	}
+	// The live link was pointed at a different directory since the backup
+	liveLink := filepath.Join(live, "dirlink")
+	if err := os.Symlink(filepath.Join(root, "new"), liveLink); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := Files(stored, liveLink, nil, nil)
+	if err != nil {
+		t.Fatalf("Files() error = %v", err)
+	}
+	for _, want := range []string{"link → " + filepath.Join(root, "old"), "link → " + filepath.Join(root, "new")} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Files() = %q, want it to contain %q", out, want)
+		}
+	}
+
+	cfg := &config.Config{
+		BackupDir:  backupDir,
+		Symlinks:   config.SymlinksPreserve,
+		CustomApps: map[string]config.AppConfig{"app": {Paths: []string{live}}},
+	}
+	differs, err := Diff(cfg, "", "", nil)
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+	if !differs {
+		t.Error("Diff() found no difference between the two link targets")
+	}
+
+	// Same target again
+	if err := os.Remove(liveLink); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "old"), liveLink); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := Links(stored, liveLink); err != nil || out != "" {
+		t.Errorf("Links() = %q, %v, want no difference", out, err)
+	}
+}
+
+func TestFilesHidesRedactedSecrets(t *testing.T) {
+	root := t.TempDir()
+	stored := filepath.Join(root, "backup", ".npmrc")
+	live := filepath.Join(root, "live", ".npmrc")
+	for _, path := range []string{stored, live} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules, err := redact.Compile([]config.RedactRule{{Name: "NPM_TOKEN", Files: ".npmrc", Pattern: `_authToken=(\S+)`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const secret = "npm_SECRETTOKEN123"
+	if err := os.WriteFile(stored, []byte("//registry.npmjs.org/:_authToken={{gitbak-secret:NPM_TOKEN}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the secret differs from the backup copy
+	if err := os.WriteFile(live, []byte("//registry.npmjs.org/:_authToken="+secret+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := Files(stored, live, nil, rules); err != nil || out != "" {
+		t.Errorf("Files() = %q, %v, want no difference", out, err)
+	}
+
+	// A real change shows, the secret still doesn't
+	if err := os.WriteFile(live, []byte("registry=https://npm.corp/\n//registry.npmjs.org/:_authToken="+secret+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := Files(stored, live, nil, rules)
+	if err != nil {
+		t.Fatalf("Files() error = %v", err)
+	}
+	if !strings.Contains(out, "+registry=https://npm.corp/") {
+		t.Errorf("Files() = %q, want the added line", out)
+	}
+	if strings.Contains(out, secret) {
+		t.Errorf("Files() = %q, leaks the secret", out)
+	}
+}
@@ -0,0 +1,202 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// contextLines is the number of unchanged lines shown around each change
+const contextLines = 3
+
+type opKind int
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+// edit is a single line of an edit script. aIdx and bIdx are the positions in
+// the old and new line slices at which the edit applies.
+type edit struct {
+	kind opKind
+	aIdx int
+	bIdx int
+	text string
+}
+
+// IsBinary reports whether data looks like binary content, using the same
+// heuristic as git: a NUL byte within the first 8000 bytes
+func IsBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// Unified returns a unified diff turning a into b, labelled with aName and
+// bName. It returns an empty string if the contents are identical.
+func Unified(aName, bName string, a, b []byte) string {
+	if bytes.Equal(a, b) {
+		return ""
+	}
+
+	aLines := splitLines(a)
+	bLines := splitLines(b)
+	edits := myers(aLines, bLines)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n", aName)
+	fmt.Fprintf(&sb, "+++ %s\n", bName)
+
+	for _, h := range hunks(edits) {
+		aStart, bStart := edits[h[0]].aIdx, edits[h[0]].bIdx
+		aLen, bLen := 0, 0
+		for _, e := range edits[h[0]:h[1]] {
+			if e.kind != opInsert {
+				aLen++
+			}
+			if e.kind != opDelete {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+
+		for _, e := range edits[h[0]:h[1]] {
+			prefix := " "
+			switch e.kind {
+			case opDelete:
+				prefix = "-"
+			case opInsert:
+				prefix = "+"
+			}
+			sb.WriteString(prefix)
+			sb.WriteString(e.text)
+			if !strings.HasSuffix(e.text, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return sb.String()
+}
+
+// hunkRange formats the start,length part of a hunk header. Following the
+// unified format, an empty range names the line before it.
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+// splitLines splits data into lines, keeping the trailing newline on each
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			lines = append(lines, string(data))
+			break
+		}
+		lines = append(lines, string(data[:i+1]))
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// hunks groups the edit script into [start, end) ranges of edits, each
+// holding a run of changes with up to contextLines of surrounding context.
+// Changes separated by no more than twice that many equal lines share a hunk.
+func hunks(edits []edit) [][2]int {
+	var result [][2]int
+	lastChange := -1
+	for i, e := range edits {
+		if e.kind == opEqual {
+			continue
+		}
+		end := min(i+1+contextLines, len(edits))
+		if lastChange >= 0 && i-lastChange-1 <= 2*contextLines {
+			result[len(result)-1][1] = end
+		} else {
+			result = append(result, [2]int{max(0, i-contextLines), end})
+		}
+		lastChange = i
+	}
+	return result
+}
+
+// myers computes a shortest edit script from a to b using Myers' O(ND)
+// difference algorithm
+func myers(a, b []string) []edit {
+	n, m := len(a), len(b)
+	maxD := n + m
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	var trace [][]int
+
+	for d := 0; d <= maxD; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, a, b, offset)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrack(trace [][]int, a, b []string, offset int) []edit {
+	x, y := len(a), len(b)
+	var edits []edit
+
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, edit{kind: opEqual, aIdx: x, bIdx: y, text: a[x]})
+		}
+		if d > 0 {
+			if x == prevX {
+				y--
+				edits = append(edits, edit{kind: opInsert, aIdx: x, bIdx: y, text: b[y]})
+			} else {
+				x--
+				edits = append(edits, edit{kind: opDelete, aIdx: x, bIdx: y, text: a[x]})
+			}
+		}
+	}
+
+	// The script was built from the end; put it in order
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
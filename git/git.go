@@ -2,44 +2,323 @@ package git
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
-	"time"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kennyparsons/gitbak/backup"
+	"github.com/kennyparsons/gitbak/config"
+)
+
+// Commit modes for commit_mode in gitbak.json
+const (
+	// CommitModeSingle commits every change of a backup run at once
+	CommitModeSingle = "single"
+	// CommitModePerApp commits each app's subtree of backup_dir separately
+	CommitModePerApp = "per-app"
 )
 
-// CommitAndPush stages all changes, commits with a timestamp, and pushes
-func CommitAndPush(backupDir string, dryRun bool) error {
+// plannedCommit is one commit CommitAndPush is going to make. An empty
+// pathspec commits everything that is left.
+type plannedCommit struct {
+	pathspec string
+	message  string
+}
+
+// CommitAndPush stages all changes, commits with a message describing the
+// backup result, and pushes according to the configured sync strategy. With
+// commit_mode "per-app", each changed app is committed on its own, followed
+// by a final commit for anything left over such as the metadata file.
+func CommitAndPush(cfg *config.Config, result *backup.Result, dryRun bool) error {
+	backupDir := cfg.BackupDir
+	// Changes left over from a run that didn't commit are described along
+	// with this run's, so they still get their own commits and messages
+	pending, err := pendingChanges(cfg)
+	if err != nil {
+		return err
+	}
+	apps := withPending(result.Apps, pending)
+	commits, err := planCommits(cfg, apps)
+	if err != nil {
+		return err
+	}
+	strategy := syncStrategy(cfg)
+	syncCmds, err := syncCommands(strategy, backupDir, cfg.Host())
+	if err != nil {
+		return err
+	}
+
 	if dryRun {
-		fmt.Printf("[dry-run] git -C %s add -A\n", backupDir)
-		fmt.Printf("[dry-run] git -C %s diff --quiet || git -C %s commit -m \"gitbak backup: %s\"\n", backupDir, backupDir, time.Now().Format("2006-01-02 15:04:05"))
-		fmt.Printf("[dry-run] git -C %s push\n", backupDir)
+		for _, c := range commits {
+			pathspec := ""
+			if c.pathspec != "" {
+				pathspec = " -- " + c.pathspec
+			}
+			fmt.Printf("[dry-run] git -C %s add -A%s\n", backupDir, pathspec)
+			fmt.Printf("[dry-run] git -C %s diff --quiet --cached%s || git -C %s commit -F -%s <<EOF\n%sEOF\n",
+				backupDir, pathspec, backupDir, pathspec, c.message)
+		}
+		for _, cmd := range syncCmds {
+			fmt.Printf("[dry-run] %s\n", cmd)
+		}
+		return nil
+	}
+
+	committed := false
+	for _, c := range commits {
+		ok, err := commit(backupDir, c)
+		if err != nil {
+			return err
+		}
+		committed = committed || ok
+	}
+
+	if !committed {
+		// No changes to commit
+		fmt.Println("No changes to commit")
 		return nil
 	}
 
+	// Only push if there was a commit
+	return sync(strategy, backupDir, cfg.Host(), &backup.Result{Apps: apps})
+}
+
+// withPending adds the pending changes that aren't part of the backup
+// results to them, returning the apps sorted by name
+func withPending(results, pending []backup.AppResult) []backup.AppResult {
+	apps := make(map[string]*backup.AppResult)
+	var names []string
+	for _, app := range results {
+		app := app
+		apps[app.Name] = &app
+		names = append(names, app.Name)
+	}
+	for _, p := range pending {
+		app := apps[p.Name]
+		if app == nil {
+			app = &backup.AppResult{Name: p.Name}
+			apps[p.Name] = app
+			names = append(names, p.Name)
+		}
+		known := make(map[string]bool)
+		for _, files := range [][]string{app.Added, app.Modified, app.Deleted} {
+			for _, f := range files {
+				known[f] = true
+			}
+		}
+		for _, f := range p.Added {
+			if !known[f] {
+				app.Added = append(app.Added, f)
+			}
+		}
+		for _, f := range p.Modified {
+			if !known[f] {
+				app.Modified = append(app.Modified, f)
+			}
+		}
+		for _, f := range p.Deleted {
+			if !known[f] {
+				app.Deleted = append(app.Deleted, f)
+			}
+		}
+	}
+
+	sort.Strings(names)
+	merged := make([]backup.AppResult, 0, len(names))
+	for _, name := range names {
+		app := apps[name]
+		sort.Strings(app.Added)
+		sort.Strings(app.Modified)
+		sort.Strings(app.Deleted)
+		merged = append(merged, *app)
+	}
+	return merged
+}
+
+// planCommits works out the commits to make for the changes of apps
+// according to the configured commit mode
+func planCommits(cfg *config.Config, apps []backup.AppResult) ([]plannedCommit, error) {
+	switch cfg.CommitMode {
+	case "", CommitModeSingle:
+		msg, err := CommitMessage(cfg.CommitMessageTemplate, cfg.Host(), apps)
+		if err != nil {
+			return nil, err
+		}
+		return []plannedCommit{{message: msg}}, nil
+
+	case CommitModePerApp:
+		var commits []plannedCommit
+		for _, app := range apps {
+			if !app.Changed() {
+				continue
+			}
+			msg, err := CommitMessage(cfg.CommitMessageTemplate, cfg.Host(), []backup.AppResult{app})
+			if err != nil {
+				return nil, err
+			}
+			commits = append(commits, plannedCommit{pathspec: app.Name, message: msg})
+		}
+		// Whatever the app commits didn't cover, e.g. the metadata file
+		msg, err := CommitMessage(cfg.CommitMessageTemplate, cfg.Host(), nil)
+		if err != nil {
+			return nil, err
+		}
+		return append(commits, plannedCommit{message: msg}), nil
+
+	default:
+		return nil, fmt.Errorf("invalid commit_mode %q, must be %q or %q", cfg.CommitMode, CommitModeSingle, CommitModePerApp)
+	}
+}
+
+// commit stages and commits the changes covered by c, and reports whether a
+// commit was made
+func commit(backupDir string, c plannedCommit) (bool, error) {
+	pathspec := pathspecArgs(c.pathspec)
+
 	// First add all changes
-	cmdAdd := exec.Command("git", "-C", backupDir, "add", "-A")
+	cmdAdd := exec.Command("git", append([]string{"-C", backupDir, "add", "-A"}, pathspec...)...)
 	if out, err := cmdAdd.CombinedOutput(); err != nil {
-		return fmt.Errorf("git add failed: %v - %s", err, string(out))
+		return false, fmt.Errorf("git add failed: %v - %s", err, string(out))
 	}
 
 	// Check if there are any changes to commit
-	cmdDiff := exec.Command("git", "-C", backupDir, "diff", "--quiet", "--cached")
+	cmdDiff := exec.Command("git", append([]string{"-C", backupDir, "diff", "--quiet", "--cached"}, pathspec...)...)
 	if err := cmdDiff.Run(); err == nil {
-		// No changes to commit
-		fmt.Println("No changes to commit")
-		return nil
+		return false, nil
 	}
 
 	// If we get here, there are changes to commit
-	msg := fmt.Sprintf("gitbak backup: %s", time.Now().Format("2006-01-02 15:04:05"))
-	cmdCommit := exec.Command("git", "-C", backupDir, "commit", "-m", msg)
+	cmdCommit := exec.Command("git", append([]string{"-C", backupDir, "commit", "-F", "-"}, pathspec...)...)
+	cmdCommit.Stdin = strings.NewReader(c.message)
 	if out, err := cmdCommit.CombinedOutput(); err != nil {
-		return fmt.Errorf("git commit failed: %v - %s", err, string(out))
+		return false, fmt.Errorf("git commit failed: %v - %s", err, string(out))
+	}
+	return true, nil
+}
+
+// pathspecArgs returns the trailing "-- <pathspec>" arguments for a git
+// command, or nothing for an empty pathspec
+func pathspecArgs(pathspec string) []string {
+	if pathspec == "" {
+		return nil
 	}
+	return []string{"--", pathspec}
+}
 
-	// Only push if there was a commit
-	cmdPush := exec.Command("git", "-C", backupDir, "push")
-	if out, err := cmdPush.CombinedOutput(); err != nil {
-		return fmt.Errorf("git push failed: %v - %s", err, string(out))
+// pendingChanges returns the changes in backup_dir the next commit would
+// pick up, staged or not, grouped by the configured app whose directory they
+// are in. Paths are relative to backup_dir/<app>, and apps are sorted by
+// name. Files outside the app directories, like the metadata file, are left
+// out.
+func pendingChanges(cfg *config.Config) ([]backup.AppResult, error) {
+	prefix, err := exec.Command("git", "-C", cfg.BackupDir, "rev-parse", "--show-prefix").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git rev-parse failed: %v - %s", err, stderrOf(err))
+	}
+	out, err := exec.Command("git", "-C", cfg.BackupDir, "status", "--porcelain", "-z", "--untracked-files=all", "--", ".").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git status failed: %v - %s", err, stderrOf(err))
+	}
+
+	apps := make(map[string]*backup.AppResult)
+	add := func(path string, change backup.Change) {
+		// Status paths are relative to the top of the repository
+		rel := strings.TrimPrefix(path, strings.TrimSpace(string(prefix)))
+		name, file, ok := strings.Cut(rel, "/")
+		if _, isApp := cfg.CustomApps[name]; !ok || !isApp {
+			return
+		}
+		app := apps[name]
+		if app == nil {
+			app = &backup.AppResult{Name: name}
+			apps[name] = app
+		}
+		file = filepath.FromSlash(file)
+		switch change {
+		case backup.Added:
+			app.Added = append(app.Added, file)
+		case backup.Deleted:
+			app.Deleted = append(app.Deleted, file)
+		default:
+			app.Modified = append(app.Modified, file)
+		}
+	}
+
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i < len(fields); i++ {
+		entry := fields[i]
+		if len(entry) < 4 {
+			continue
+		}
+		status, path := entry[:2], entry[3:]
+		switch {
+		case status[0] == 'R' || status[0] == 'C':
+			// The original path follows as its own field
+			i++
+			if status[0] == 'R' && i < len(fields) {
+				add(fields[i], backup.Deleted)
+			}
+			add(path, backup.Added)
+		case status == "??" || status[0] == 'A':
+			add(path, backup.Added)
+		case status[0] == 'D' || status[1] == 'D':
+			add(path, backup.Deleted)
+		default:
+			add(path, backup.Modified)
+		}
+	}
+
+	var names []string
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := &backup.Result{}
+	for _, name := range names {
+		app := apps[name]
+		sort.Strings(app.Added)
+		sort.Strings(app.Modified)
+		sort.Strings(app.Deleted)
+		result.Apps = append(result.Apps, *app)
+	}
+	return result.Apps, nil
+}
+
+// PendingFiles returns the files in the backup repository that the next
+// commit would pick up: modified, staged and untracked files. Deleted files
+// are left out. Paths are absolute.
+func PendingFiles(backupDir string) ([]string, error) {
+	top, err := output(backupDir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	if len(top) == 0 {
+		return nil, fmt.Errorf("could not find the top of the repository in %s", backupDir)
+	}
+
+	out, err := exec.Command("git", "-C", backupDir, "status", "--porcelain", "-z", "--untracked-files=all").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git status failed: %v - %s", err, stderrOf(err))
+	}
+
+	var files []string
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i < len(fields); i++ {
+		entry := fields[i]
+		if len(entry) < 4 {
+			continue
+		}
+		status, path := entry[:2], entry[3:]
+		if status[0] == 'R' || status[0] == 'C' {
+			// The original path of a rename or copy follows as its own field
+			i++
+		}
+		path = filepath.Join(top[0], path)
+		if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+			files = append(files, path)
+		}
 	}
-	return nil
+	return files, nil
 }
@@ -0,0 +1,197 @@
+package git
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kennyparsons/gitbak/backup"
+	"github.com/kennyparsons/gitbak/config"
+)
+
+func TestPlanCommits(t *testing.T) {
+	result := &backup.Result{Apps: []backup.AppResult{
+		{Name: "nvim", Modified: []string{"nvim/init.lua"}},
+		{Name: "ssh", Unchanged: 2},
+		{Name: "zsh", Added: []string{".zshrc"}},
+	}}
+
+	commits, err := planCommits(&config.Config{}, result.Apps)
+	if err != nil {
+		t.Fatalf("planCommits failed: %v", err)
+	}
+	if len(commits) != 1 || commits[0].pathspec != "" {
+		t.Errorf("single mode planned %+v, want one commit of everything", commits)
+	}
+
+	commits, err = planCommits(&config.Config{CommitMode: CommitModePerApp}, result.Apps)
+	if err != nil {
+		t.Fatalf("planCommits failed: %v", err)
+	}
+	var pathspecs []string
+	for _, c := range commits {
+		pathspecs = append(pathspecs, c.pathspec)
+	}
+	if len(pathspecs) != 3 || pathspecs[0] != "nvim" || pathspecs[1] != "zsh" || pathspecs[2] != "" {
+		t.Errorf("per-app mode planned pathspecs %q, want [nvim zsh \"\"]", pathspecs)
+	}
+
+	if _, err := planCommits(&config.Config{CommitMode: "per-file"}, result.Apps); err == nil {
+		t.Error("planCommits accepted an invalid commit mode")
+	}
+}
+
+func TestOverlapping(t *testing.T) {
+	result := &backup.Result{Apps: []backup.AppResult{
+		{Name: "zsh", Modified: []string{".zshrc"}},
+		{Name: "nvim", Added: []string{"nvim/lua/plugins.lua"}, Deleted: []string{"nvim/old.lua"}},
+	}}
+	remote := []string{".gitbak_metadata.json", "nvim/nvim/old.lua", "zsh/.zshrc", "git/.gitconfig"}
+
+	got := overlapping(remote, result)
+	if len(got) != 2 || got[0] != "nvim/nvim/old.lua" || got[1] != "zsh/.zshrc" {
+		t.Errorf("overlapping() = %q, want [nvim/nvim/old.lua zsh/.zshrc]", got)
+	}
+}
+
+// newTestRepo returns a backup repository with one commit, pushed to a bare
+// origin whose path is returned as well
+func newTestRepo(t *testing.T) (string, string) {
+	t.Helper()
+	for _, v := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(v, "gitbak test")
+	}
+	for _, v := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(v, "test@example.com")
+	}
+	root := t.TempDir()
+	remote := filepath.Join(root, "remote.git")
+	repo := filepath.Join(root, "backup")
+	runGit(t, root, "init", "--quiet", "--bare", "-b", "main", remote)
+	runGit(t, root, "init", "--quiet", "-b", "main", repo)
+	writeFile(t, filepath.Join(repo, "README.md"), "backups\n")
+	runGit(t, repo, "add", "-A")
+	runGit(t, repo, "commit", "--quiet", "-m", "initial")
+	runGit(t, repo, "remote", "add", "origin", remote)
+	runGit(t, repo, "push", "--quiet", "-u", "origin", "main")
+	return repo, remote
+}
+
+// runGit runs git in dir and returns its trimmed output
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v - %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommitAndPushPerAppRerun(t *testing.T) {
+	repo, remote := newTestRepo(t)
+	cfg := &config.Config{
+		BackupDir:  repo,
+		CommitMode: CommitModePerApp,
+		CustomApps: map[string]config.AppConfig{"nvim": {}, "zsh": {}},
+	}
+
+	// A previous run copied files but never committed them; some were even
+	// staged already
+	writeFile(t, filepath.Join(repo, "nvim", "nvim", "init.lua"), "set number\n")
+	writeFile(t, filepath.Join(repo, "zsh", ".zshrc"), "export EDITOR=nvim\n")
+	writeFile(t, filepath.Join(repo, ".gitbak_metadata.json"), "{}\n")
+	runGit(t, repo, "add", "zsh")
+
+	// This run found nothing new
+	if err := CommitAndPush(cfg, &backup.Result{}, false); err != nil {
+		t.Fatalf("CommitAndPush failed: %v", err)
+	}
+
+	if n := runGit(t, remote, "rev-list", "--count", "main"); n != "4" {
+		t.Fatalf("remote has %s commits, want three backup commits on top of the initial one", n)
+	}
+	for i, want := range []struct{ subject, file string }{
+		{"nvim", "nvim/nvim/init.lua"},
+		{"zsh", "zsh/.zshrc"},
+		{"", ".gitbak_metadata.json"},
+	} {
+		rev := "main~" + strconv.Itoa(2-i)
+		subject := runGit(t, remote, "log", "-1", "--format=%s", rev)
+		files := runGit(t, remote, "show", "--name-only", "--format=", rev)
+		if files != want.file || !strings.Contains(subject, want.subject) {
+			t.Errorf("commit %d %q has %q, want %s committed on its own", i+1, subject, files, want.file)
+		}
+	}
+}
+
+func TestWithPending(t *testing.T) {
+	results := []backup.AppResult{
+		{Name: "zsh", Modified: []string{".zshrc"}, Unchanged: 1},
+		{Name: "nvim", Unchanged: 3},
+	}
+	pending := []backup.AppResult{
+		{Name: "git", Added: []string{".gitconfig"}},
+		{Name: "zsh", Modified: []string{".zshrc", ".zprofile"}},
+	}
+	got := withPending(results, pending)
+	want := []backup.AppResult{
+		{Name: "git", Added: []string{".gitconfig"}},
+		{Name: "nvim", Unchanged: 3},
+		{Name: "zsh", Modified: []string{".zprofile", ".zshrc"}, Unchanged: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withPending() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCommitAndPushDryRunPerApp(t *testing.T) {
+	repo, _ := newTestRepo(t)
+	cfg := &config.Config{
+		BackupDir:  repo,
+		CommitMode: CommitModePerApp,
+		CustomApps: map[string]config.AppConfig{"nvim": {}, "ssh": {}},
+	}
+	// A dry run copies nothing, so only the result knows what changed
+	result := &backup.Result{Apps: []backup.AppResult{
+		{Name: "nvim", Modified: []string{"nvim/init.lua"}},
+		{Name: "ssh", Added: []string{".ssh/config"}},
+	}}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = CommitAndPush(cfg, result, true)
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("CommitAndPush failed: %v", err)
+	}
+
+	for _, want := range []string{"add -A -- nvim\n", "gitbak backup: nvim (1 file)", "add -A -- ssh\n", "gitbak backup: ssh (1 file)"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("dry run printed\n%s\nwant it to contain %q", out, want)
+		}
+	}
+	if n := runGit(t, repo, "rev-list", "--count", "HEAD"); n != "1" {
+		t.Errorf("dry run committed, HEAD has %s commits", n)
+	}
+}
@@ -0,0 +1,212 @@
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Commit identifies a single commit in the backup repository
+type Commit struct {
+	Hash string
+	Date time.Time
+}
+
+// ResolveRev resolves a commit, tag or branch name to a commit in the backup
+// repository. If at is not empty, it selects the last commit reachable from
+// rev (or HEAD) made at or before that date instead; any date format git
+// understands is accepted, e.g. "2026-09-01" or "2 weeks ago".
+func ResolveRev(backupDir, rev, at string) (Commit, error) {
+	if rev == "" {
+		rev = "HEAD"
+	}
+
+	args := []string{"-C", backupDir, "log", "-1", "--format=%H %cI"}
+	if at != "" {
+		args = append(args, "--before="+at)
+	}
+	args = append(args, rev+"^{commit}", "--")
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return Commit{}, fmt.Errorf("git could not resolve %s: %v - %s", rev, err, stderrOf(err))
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		if at != "" {
+			return Commit{}, fmt.Errorf("no commit found in %s at or before %s", rev, at)
+		}
+		return Commit{}, fmt.Errorf("git could not resolve %s", rev)
+	}
+	date, err := time.Parse(time.RFC3339, fields[1])
+	if err != nil {
+		return Commit{}, fmt.Errorf("unexpected commit date %q: %v", fields[1], err)
+	}
+	return Commit{Hash: fields[0], Date: date}, nil
+}
+
+// ExportTree writes the contents of backupDir as of commit into dest, without
+// touching the working tree or index of the backup repository. backupDir may
+// be a subdirectory of the repository, in which case only that subtree is
+// exported.
+func ExportTree(backupDir, commit, dest string) error {
+	top, err := exec.Command("git", "-C", backupDir, "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return fmt.Errorf("git rev-parse failed: %v - %s", err, stderrOf(err))
+	}
+	prefix, err := exec.Command("git", "-C", backupDir, "rev-parse", "--show-prefix").Output()
+	if err != nil {
+		return fmt.Errorf("git rev-parse failed: %v - %s", err, stderrOf(err))
+	}
+
+	// git archive refuses to run from inside a subdirectory, so archive the
+	// subtree from the top of the repository instead
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "-C", strings.TrimSpace(string(top)), "archive", "--format=tar", commit+":"+strings.TrimSpace(string(prefix)))
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("git archive failed: %v", err)
+	}
+
+	extractErr := extractTar(stdout, dest)
+	// Drain whatever is left so git can exit
+	io.Copy(io.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("git archive failed: %v - %s", err, stderr.String())
+	}
+	return extractErr
+}
+
+// extractTar unpacks a tar stream produced by git archive into dest
+func extractTar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+
+		// git archive only produces relative paths, but don't trust that
+		if filepath.IsAbs(hdr.Name) || strings.HasPrefix(hdr.Name, "/") {
+			return fmt.Errorf("archive entry %s escapes destination", hdr.Name)
+		}
+		target := filepath.Join(dest, hdr.Name)
+		if rel, err := filepath.Rel(dest, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("archive entry %s escapes destination", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+		default:
+			// git archive produces nothing else worth restoring (e.g. the
+			// pax global header carrying the commit id)
+		}
+	}
+}
+
+// stderrOf returns the captured stderr of a failed exec.Cmd.Output call
+func stderrOf(err error) string {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return strings.TrimSpace(string(exitErr.Stderr))
+	}
+	return ""
+}
+
+// LogEntry is a commit in the backup history along with the files it changed
+type LogEntry struct {
+	Commit
+	Subject string
+	Files   []FileChange
+}
+
+// FileChange is a file touched by a commit, with its git status letter
+// (A, M, D, R, ...)
+type FileChange struct {
+	Status string
+	Path   string
+}
+
+// Log lists commits in the backup repository that touched any of paths
+// (relative to backupDir), newest first. An empty paths lists every commit.
+// File paths in the result are relative to backupDir. A limit of 0 or less
+// returns the whole history.
+func Log(backupDir string, paths []string, limit int) ([]LogEntry, error) {
+	args := []string{"-C", backupDir, "log", "--relative", "--name-status", "--format=%x1e%H%x1f%cI%x1f%s"}
+	if limit > 0 {
+		args = append(args, fmt.Sprintf("-n%d", limit))
+	}
+	args = append(args, "--")
+	args = append(args, paths...)
+
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git log failed: %v - %s", err, stderrOf(err))
+	}
+
+	var entries []LogEntry
+	for _, record := range strings.Split(string(out), "\x1e") {
+		if strings.TrimSpace(record) == "" {
+			continue
+		}
+		lines := strings.Split(record, "\n")
+		header := strings.SplitN(lines[0], "\x1f", 3)
+		if len(header) != 3 {
+			return nil, fmt.Errorf("unexpected git log output: %q", lines[0])
+		}
+		date, err := time.Parse(time.RFC3339, header[1])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected commit date %q: %v", header[1], err)
+		}
+
+		entry := LogEntry{Commit: Commit{Hash: header[0], Date: date}, Subject: header[2]}
+		for _, line := range lines[1:] {
+			fields := strings.Split(line, "\t")
+			if len(fields) < 2 || fields[0] == "" {
+				continue
+			}
+			// Renames and copies list the old and new path; keep the new one
+			entry.Files = append(entry.Files, FileChange{Status: fields[0][:1], Path: fields[len(fields)-1]})
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,105 @@
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// commitAt commits everything in repo with the given commit date
+func commitAt(t *testing.T, repo, date, message string) {
+	t.Helper()
+	t.Setenv("GIT_AUTHOR_DATE", date)
+	t.Setenv("GIT_COMMITTER_DATE", date)
+	runGit(t, repo, "add", "-A")
+	runGit(t, repo, "commit", "--quiet", "-m", message)
+}
+
+func TestResolveRevAndExportTree(t *testing.T) {
+	repo, _ := newTestRepo(t)
+	// Backups kept in a subdirectory of the repository
+	backupDir := filepath.Join(repo, "backups")
+	zshrc := filepath.Join(backupDir, "zsh", ".zshrc")
+	writeFile(t, zshrc, "first\n")
+	writeFile(t, filepath.Join(repo, "outside"), "not a backup\n")
+	commitAt(t, repo, "2026-09-01T12:00:00Z", "first backup")
+	first := runGit(t, repo, "rev-parse", "HEAD")
+	runGit(t, repo, "tag", "first")
+
+	writeFile(t, zshrc, "second\n")
+	writeFile(t, filepath.Join(backupDir, "git", ".gitconfig"), "[user]\n")
+	commitAt(t, repo, "2026-09-10T12:00:00Z", "second backup")
+	second := runGit(t, repo, "rev-parse", "HEAD")
+
+	for _, tt := range []struct {
+		rev, at, want string
+	}{
+		{want: second},
+		{rev: "first", want: first},
+		{rev: first[:10], want: first},
+		{at: "2026-09-05", want: first},
+		{at: "2026-09-11", want: second},
+	} {
+		commit, err := ResolveRev(backupDir, tt.rev, tt.at)
+		if err != nil {
+			t.Errorf("ResolveRev(%q, %q) error = %v", tt.rev, tt.at, err)
+			continue
+		}
+		if commit.Hash != tt.want {
+			t.Errorf("ResolveRev(%q, %q) = %s, want %s", tt.rev, tt.at, commit.Hash, tt.want)
+		}
+	}
+	if _, err := ResolveRev(backupDir, "", "2020-01-01"); err == nil {
+		t.Error("ResolveRev() found a commit before the first one")
+	}
+	if _, err := ResolveRev(backupDir, "no-such-tag", ""); err == nil {
+		t.Error("ResolveRev() resolved a tag that doesn't exist")
+	}
+
+	// The working tree moved on since, which the export must not see
+	writeFile(t, zshrc, "uncommitted\n")
+	dest := t.TempDir()
+	if err := ExportTree(backupDir, first, dest); err != nil {
+		t.Fatalf("ExportTree() error = %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "zsh", ".zshrc")); string(data) != "first\n" {
+		t.Errorf("exported zsh/.zshrc = %q, want %q", data, "first\n")
+	}
+	for _, name := range []string{filepath.Join("git", ".gitconfig"), "outside", filepath.Join("backups", "zsh", ".zshrc")} {
+		if _, err := os.Lstat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Errorf("ExportTree() wrote %s: %v", name, err)
+		}
+	}
+	if status := runGit(t, repo, "status", "--porcelain"); status != "M backups/zsh/.zshrc" {
+		t.Errorf("ExportTree() touched the repository, status = %q", status)
+	}
+}
+
+func TestExtractTarRejectsEscapingEntries(t *testing.T) {
+	for _, name := range []string{"../evil", "zsh/../../evil", "/etc/evil", "/evil"} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 4}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte("evil")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		root := t.TempDir()
+		dest := filepath.Join(root, "dest")
+		err := extractTar(&buf, dest)
+		if err == nil || !strings.Contains(err.Error(), "escapes destination") {
+			t.Errorf("extractTar(%s) error = %v, want it rejected", name, err)
+		}
+		if entries, _ := os.ReadDir(root); len(entries) != 0 {
+			t.Errorf("extractTar(%s) wrote %d entries", name, len(entries))
+		}
+	}
+}
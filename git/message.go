@@ -0,0 +1,82 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/kennyparsons/gitbak/backup"
+)
+
+// DefaultCommitMessageTemplate names the changed apps in the subject and
+// lists every added (A), modified (M) and deleted (D) file in the body
+const DefaultCommitMessageTemplate = `gitbak backup: {{if .AppNames}}{{join .AppNames ", "}} ({{.Files}} {{if eq .Files 1}}file{{else}}files{{end}}){{else}}{{.Time.Format "2006-01-02 15:04:05"}}{{end}}
+
+Host: {{.Hostname}}
+Time: {{.Time.Format "2006-01-02 15:04:05"}}
+{{range .Apps}}
+{{.Name}}:
+{{range .Added}}  A {{.}}
+{{end}}{{range .Modified}}  M {{.}}
+{{end}}{{range .Deleted}}  D {{.}}
+{{end}}{{end}}`
+
+// MessageData is the data available to commit_message_template
+type MessageData struct {
+	// Hostname is the name the machine's backups are stored under, as set
+	// by host_name
+	Hostname string
+	Time     time.Time
+	// Apps holds the apps with at least one changed file
+	Apps     []backup.AppResult
+	AppNames []string
+	Added    int
+	Modified int
+	Deleted  int
+	// Files is the total number of changed files
+	Files int
+}
+
+// newMessageData builds the template data for the changed apps in results
+func newMessageData(host string, results []backup.AppResult) MessageData {
+	data := MessageData{Hostname: host, Time: time.Now()}
+	for _, app := range results {
+		if !app.Changed() {
+			continue
+		}
+		data.Apps = append(data.Apps, app)
+		data.AppNames = append(data.AppNames, app.Name)
+		data.Added += len(app.Added)
+		data.Modified += len(app.Modified)
+		data.Deleted += len(app.Deleted)
+	}
+	data.Files = data.Added + data.Modified + data.Deleted
+	return data
+}
+
+// CommitMessage renders the commit message for a set of app results backed
+// up on host using tmpl, or DefaultCommitMessageTemplate if tmpl is empty
+func CommitMessage(tmpl, host string, results []backup.AppResult) (string, error) {
+	if tmpl == "" {
+		tmpl = DefaultCommitMessageTemplate
+	}
+	t, err := template.New("commit_message").Funcs(template.FuncMap{
+		"join": strings.Join,
+	}).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid commit_message_template: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, newMessageData(host, results)); err != nil {
+		return "", fmt.Errorf("failed to render commit_message_template: %v", err)
+	}
+
+	msg := strings.TrimSpace(buf.String())
+	if msg == "" {
+		return "", fmt.Errorf("commit_message_template rendered an empty message")
+	}
+	return msg + "\n", nil
+}
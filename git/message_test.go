@@ -0,0 +1,48 @@
+package git
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kennyparsons/gitbak/backup"
+)
+
+func TestCommitMessage(t *testing.T) {
+	results := []backup.AppResult{
+		{Name: "nvim", Added: []string{"nvim/new.lua"}, Modified: []string{"nvim/init.lua"}},
+		{Name: "ssh", Unchanged: 4},
+		{Name: "zsh", Deleted: []string{".zprofile"}},
+	}
+
+	msg, err := CommitMessage("", "work-laptop", results)
+	if err != nil {
+		t.Fatalf("CommitMessage failed: %v", err)
+	}
+	lines := strings.Split(msg, "\n")
+	if lines[0] != "gitbak backup: nvim, zsh (3 files)" {
+		t.Errorf("subject = %q", lines[0])
+	}
+	for _, want := range []string{"  A nvim/new.lua", "  M nvim/init.lua", "  D .zprofile"} {
+		if !strings.Contains(msg, want+"\n") {
+			t.Errorf("message does not list %q:\n%s", want, msg)
+		}
+	}
+	if !strings.Contains(msg, "\nHost: work-laptop\n") {
+		t.Errorf("message does not name the host:\n%s", msg)
+	}
+	if strings.Contains(msg, "ssh") {
+		t.Errorf("message mentions unchanged app ssh:\n%s", msg)
+	}
+
+	msg, err = CommitMessage(`{{.Added}}+{{.Modified}}-{{.Deleted}} on {{len .Apps}} apps`, "work-laptop", results)
+	if err != nil {
+		t.Fatalf("CommitMessage with custom template failed: %v", err)
+	}
+	if msg != "1+1-1 on 2 apps\n" {
+		t.Errorf("custom message = %q", msg)
+	}
+
+	if _, err := CommitMessage("{{.Nope", "work-laptop", results); err == nil {
+		t.Error("CommitMessage accepted an invalid template")
+	}
+}
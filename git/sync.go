@@ -0,0 +1,321 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kennyparsons/gitbak/backup"
+	"github.com/kennyparsons/gitbak/config"
+)
+
+// Sync strategies for sync_strategy in gitbak.json
+const (
+	// SyncPush pushes straight after committing (the default)
+	SyncPush = "push"
+	// SyncRebase rebases the backup commits onto the remote before pushing
+	SyncRebase = "rebase"
+	// SyncFetchCheck fetches first and refuses to push if the remote has
+	// moved on
+	SyncFetchCheck = "fetch-check"
+	// SyncHostBranch pushes to a branch named after this machine
+	SyncHostBranch = "host-branch"
+)
+
+// DivergedError is returned when the remote has commits the local backup
+// repository doesn't, so the backup could not be pushed as is
+type DivergedError struct {
+	// Behind is the number of remote commits missing locally
+	Behind int
+	// Conflicts lists files (relative to backup_dir) changed both by this
+	// backup and on the remote
+	Conflicts []string
+}
+
+func (e *DivergedError) Error() string {
+	var sb strings.Builder
+	if e.Behind > 0 {
+		fmt.Fprintf(&sb, "remote has %d commit(s) not in the local backup repository", e.Behind)
+	} else {
+		sb.WriteString("remote has diverged from the local backup repository")
+	}
+	sb.WriteString(" (the backup is committed locally but was not pushed)")
+	switch {
+	case len(e.Conflicts) > 0:
+		sb.WriteString("; files changed both here and on the remote:")
+		for _, f := range e.Conflicts {
+			sb.WriteString("\n  ")
+			sb.WriteString(f)
+		}
+	case e.Behind > 0:
+		sb.WriteString("; none of them touch files changed by this backup, so sync_strategy \"rebase\" can integrate them")
+	default:
+		sb.WriteString("; set sync_strategy to \"rebase\" or \"fetch-check\", or pull manually")
+	}
+	return sb.String()
+}
+
+// HostBranch returns the branch a machine's backups go to with the
+// host-branch sync strategy or the branch host layout
+func HostBranch(host string) string {
+	return "gitbak/" + host
+}
+
+// syncStrategy returns the sync strategy to use for cfg. Backups kept on
+// per-host branches are pushed to their branch unless configured otherwise.
+func syncStrategy(cfg *config.Config) string {
+	if cfg.SyncStrategy == "" && cfg.HostLayout == config.HostLayoutBranch {
+		return SyncHostBranch
+	}
+	return cfg.SyncStrategy
+}
+
+// Fetch updates the remote-tracking branches of the backup repository
+func Fetch(backupDir string) error {
+	cmdFetch := exec.Command("git", "-C", backupDir, "fetch")
+	if out, err := cmdFetch.CombinedOutput(); err != nil {
+		return fmt.Errorf("git fetch failed: %v - %s", err, string(out))
+	}
+	return nil
+}
+
+// CheckoutHostBranch switches the backup repository to host's branch before a
+// backup, creating it if needed. A branch that only exists on the remote is
+// checked out tracking it; otherwise the new branch starts at the current
+// HEAD.
+func CheckoutHostBranch(backupDir, host string, dryRun bool) error {
+	branch := HostBranch(host)
+	current, err := output(backupDir, "rev-parse", "--abbrev-ref", "HEAD")
+	if err == nil && len(current) == 1 && current[0] == branch {
+		return nil
+	}
+
+	var args []string
+	switch {
+	case exec.Command("git", "-C", backupDir, "rev-parse", "--verify", "--quiet", "refs/heads/"+branch).Run() == nil:
+		args = []string{"checkout", branch}
+	case exec.Command("git", "-C", backupDir, "rev-parse", "--verify", "--quiet", "refs/remotes/origin/"+branch).Run() == nil:
+		args = []string{"checkout", "-b", branch, "--track", "origin/" + branch}
+	default:
+		args = []string{"checkout", "-b", branch}
+	}
+
+	if dryRun {
+		fmt.Printf("[dry-run] git -C %s %s\n", backupDir, strings.Join(args, " "))
+		return nil
+	}
+	cmd := exec.Command("git", append([]string{"-C", backupDir}, args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git checkout %s failed: %v - %s", branch, err, string(out))
+	}
+	fmt.Printf("Switched backup repository to branch %s\n", branch)
+	return nil
+}
+
+// syncCommands returns the git commands a sync strategy runs, for dry-run
+// output
+func syncCommands(strategy, backupDir, host string) ([]string, error) {
+	prefix := "git -C " + backupDir
+	switch strategy {
+	case "", SyncPush:
+		return []string{prefix + " push"}, nil
+	case SyncRebase:
+		return []string{prefix + " pull --rebase", prefix + " push"}, nil
+	case SyncFetchCheck:
+		return []string{prefix + " fetch", prefix + " rev-list --count HEAD..@{u}", prefix + " push"}, nil
+	case SyncHostBranch:
+		return []string{prefix + " push origin HEAD:refs/heads/" + HostBranch(host)}, nil
+	default:
+		return nil, fmt.Errorf("invalid sync_strategy %q, must be one of %s, %s, %s, %s", strategy, SyncPush, SyncRebase, SyncFetchCheck, SyncHostBranch)
+	}
+}
+
+// sync publishes the local backup commits according to strategy
+func sync(strategy, backupDir, host string, result *backup.Result) error {
+	switch strategy {
+	case "", SyncPush:
+		return push(backupDir)
+
+	case SyncRebase:
+		cmdPull := exec.Command("git", "-C", backupDir, "pull", "--rebase")
+		if out, err := cmdPull.CombinedOutput(); err != nil {
+			// The pull can fail before the rebase starts, e.g. when the
+			// remote can't be reached
+			if !rebaseInProgress(backupDir) {
+				return fmt.Errorf("git pull --rebase failed: %v - %s", err, string(out))
+			}
+			if err := continueRebase(backupDir, result); err != nil {
+				if _, ok := err.(*DivergedError); ok {
+					return err
+				}
+				return fmt.Errorf("git pull --rebase failed: %v - %s", err, string(out))
+			}
+		}
+		return push(backupDir)
+
+	case SyncFetchCheck:
+		if err := Fetch(backupDir); err != nil {
+			return err
+		}
+		counts, err := output(backupDir, "rev-list", "--count", "HEAD..@{u}")
+		if err != nil {
+			return err
+		}
+		behind, _ := strconv.Atoi(strings.Join(counts, ""))
+		if behind == 0 {
+			return push(backupDir)
+		}
+		remoteFiles, err := output(backupDir, "diff", "--relative", "--name-only", "HEAD...@{u}")
+		if err != nil {
+			return err
+		}
+		return &DivergedError{Behind: behind, Conflicts: overlapping(remoteFiles, result)}
+
+	case SyncHostBranch:
+		branch := HostBranch(host)
+		cmdPush := exec.Command("git", "-C", backupDir, "push", "origin", "HEAD:refs/heads/"+branch)
+		if out, err := cmdPush.CombinedOutput(); err != nil {
+			return fmt.Errorf("git push to %s failed: %v - %s", branch, err, string(out))
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("invalid sync_strategy %q", strategy)
+	}
+}
+
+// rebaseInProgress reports whether the backup repository is in the middle of
+// a rebase
+func rebaseInProgress(backupDir string) bool {
+	for _, name := range []string{"rebase-merge", "rebase-apply"} {
+		dir, err := output(backupDir, "rev-parse", "--git-path", name)
+		if err != nil || len(dir) != 1 {
+			continue
+		}
+		path := dir[0]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(backupDir, path)
+		}
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// continueRebase drives a rebase that stopped on conflicts. Conflicts in the
+// metadata file alone are resolved by merging both versions per app: the
+// local backup's sections of the apps in result that it changed, and the
+// remote's sections of every other app. Any other conflict aborts the rebase,
+// leaving the local commits as they were, and is reported as a DivergedError.
+func continueRebase(backupDir string, result *backup.Result) error {
+	var changed []string
+	for _, app := range result.ChangedApps() {
+		changed = append(changed, app.Name)
+	}
+
+	for {
+		conflicts, err := output(backupDir, "diff", "--relative", "--name-only", "--diff-filter=U")
+		if err != nil || len(conflicts) == 0 {
+			// Not stopped on a conflict, so something else went wrong
+			exec.Command("git", "-C", backupDir, "rebase", "--abort").Run()
+			return fmt.Errorf("rebase did not stop on a conflict")
+		}
+		if len(conflicts) > 1 || conflicts[0] != backup.MetadataFileName {
+			exec.Command("git", "-C", backupDir, "rebase", "--abort").Run()
+			return &DivergedError{Conflicts: conflicts}
+		}
+
+		if err := mergeMetadataConflict(backupDir, changed); err != nil {
+			exec.Command("git", "-C", backupDir, "rebase", "--abort").Run()
+			return err
+		}
+
+		cmdContinue := exec.Command("git", "-C", backupDir, "-c", "core.editor=true", "rebase", "--continue")
+		if _, err := cmdContinue.CombinedOutput(); err == nil {
+			return nil
+		}
+		// Stopped again on a later commit; go around
+	}
+}
+
+// mergeMetadataConflict resolves a conflicted metadata file by merging the
+// remote's version with the local one, and stages the result
+func mergeMetadataConflict(backupDir string, changed []string) error {
+	// While rebasing, stage 2 ("ours") is the remote commit being built on
+	// and stage 3 ("theirs") the local commit being replayed
+	remote, err := exec.Command("git", "-C", backupDir, "show", ":2:./"+backup.MetadataFileName).Output()
+	if err != nil {
+		return fmt.Errorf("git show failed: %v - %s", err, stderrOf(err))
+	}
+	local, err := exec.Command("git", "-C", backupDir, "show", ":3:./"+backup.MetadataFileName).Output()
+	if err != nil {
+		return fmt.Errorf("git show failed: %v - %s", err, stderrOf(err))
+	}
+	merged, err := backup.MergeMetadata(local, remote, changed)
+	if err != nil {
+		return fmt.Errorf("failed to merge %s: %v", backup.MetadataFileName, err)
+	}
+	if err := os.WriteFile(filepath.Join(backupDir, backup.MetadataFileName), merged, 0644); err != nil {
+		return fmt.Errorf("failed to merge %s: %v", backup.MetadataFileName, err)
+	}
+	cmdAdd := exec.Command("git", "-C", backupDir, "add", "--", backup.MetadataFileName)
+	if out, err := cmdAdd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git add failed: %v - %s", err, string(out))
+	}
+	return nil
+}
+
+func push(backupDir string) error {
+	cmdPush := exec.Command("git", "-C", backupDir, "push")
+	out, err := cmdPush.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(string(out), "[rejected]") || strings.Contains(string(out), "non-fast-forward") {
+		return &DivergedError{}
+	}
+	return fmt.Errorf("git push failed: %v - %s", err, string(out))
+}
+
+// overlapping returns the files in remoteFiles that this backup also changed
+func overlapping(remoteFiles []string, result *backup.Result) []string {
+	ours := make(map[string]bool)
+	for _, app := range result.ChangedApps() {
+		for _, files := range [][]string{app.Added, app.Modified, app.Deleted} {
+			for _, f := range files {
+				ours[path.Join(app.Name, filepath.ToSlash(f))] = true
+			}
+		}
+	}
+
+	var both []string
+	for _, f := range remoteFiles {
+		if ours[f] {
+			both = append(both, f)
+		}
+	}
+	sort.Strings(both)
+	return both
+}
+
+// output runs a git command in backupDir and returns its non-empty output
+// lines
+func output(backupDir string, args ...string) ([]string, error) {
+	out, err := exec.Command("git", append([]string{"-C", backupDir}, args...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %v - %s", args[0], err, stderrOf(err))
+	}
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
@@ -0,0 +1,174 @@
+package git
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kennyparsons/gitbak/backup"
+)
+
+// cloneRemote returns a second clone of remote, standing in for another
+// machine pushing backups to it
+func cloneRemote(t *testing.T, remote string) string {
+	t.Helper()
+	other := filepath.Join(t.TempDir(), "other")
+	runGit(t, filepath.Dir(other), "clone", "--quiet", remote, other)
+	return other
+}
+
+// commitFiles writes files into repo and commits them
+func commitFiles(t *testing.T, repo string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		writeFile(t, filepath.Join(repo, name), content)
+	}
+	runGit(t, repo, "add", "-A")
+	runGit(t, repo, "commit", "--quiet", "-m", "backup")
+}
+
+func TestSyncPush(t *testing.T) {
+	repo, remote := newTestRepo(t)
+	commitFiles(t, repo, map[string]string{"zsh/.zshrc": "local\n"})
+	if err := sync(SyncPush, repo, "laptop", &backup.Result{}); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	if got, want := runGit(t, remote, "rev-parse", "main"), runGit(t, repo, "rev-parse", "HEAD"); got != want {
+		t.Errorf("remote main = %s, want %s", got, want)
+	}
+
+	// Another machine pushed in the meantime
+	other := cloneRemote(t, remote)
+	commitFiles(t, other, map[string]string{"git/.gitconfig": "other\n"})
+	runGit(t, other, "push", "--quiet")
+	commitFiles(t, repo, map[string]string{"zsh/.zshrc": "local again\n"})
+	var diverged *DivergedError
+	if err := sync(SyncPush, repo, "laptop", &backup.Result{}); !errors.As(err, &diverged) {
+		t.Errorf("sync() error = %v, want a DivergedError", err)
+	}
+}
+
+func TestSyncRebaseMetadataConflict(t *testing.T) {
+	repo, remote := newTestRepo(t)
+	metadata := func(host, gitSum, zshSum string) string {
+		return `{"schema_version": 2, "host": "` + host + `", "apps": {
+  "git": {"files": [{"path": "git/.gitconfig", "mode": 420, "sha256": "` + gitSum + `"}]},
+  "zsh": {"files": [{"path": "zsh/.zshrc", "mode": 420, "sha256": "` + zshSum + `"}]}
+}}
+`
+	}
+	commitFiles(t, repo, map[string]string{backup.MetadataFileName: metadata("laptop", "git-old", "zsh-old")})
+	runGit(t, repo, "push", "--quiet")
+
+	// Both machines rewrite the metadata file, each backing up another app
+	other := cloneRemote(t, remote)
+	commitFiles(t, other, map[string]string{backup.MetadataFileName: metadata("other", "git-new", "zsh-old"), "git/.gitconfig": "other\n"})
+	runGit(t, other, "push", "--quiet")
+	commitFiles(t, repo, map[string]string{backup.MetadataFileName: metadata("laptop", "git-old", "zsh-new"), "zsh/.zshrc": "local\n"})
+
+	result := &backup.Result{Apps: []backup.AppResult{
+		{Name: "git", Unchanged: 1},
+		{Name: "zsh", Modified: []string{".zshrc"}},
+	}}
+	if err := sync(SyncRebase, repo, "laptop", result); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	for _, name := range []string{"git/.gitconfig", "zsh/.zshrc"} {
+		runGit(t, remote, "cat-file", "-e", "main:"+name)
+	}
+	if rebaseInProgress(repo) {
+		t.Error("sync() left a rebase in progress")
+	}
+
+	// Each app keeps the metadata of the machine that backed it up last
+	var merged backup.Metadata
+	if err := json.Unmarshal([]byte(runGit(t, remote, "show", "main:"+backup.MetadataFileName)), &merged); err != nil {
+		t.Fatalf("remote metadata is not valid: %v", err)
+	}
+	sums := make(map[string]string)
+	for _, meta := range merged.Files() {
+		sums[meta.Path] = meta.SHA256
+	}
+	if want := map[string]string{"git/.gitconfig": "git-new", "zsh/.zshrc": "zsh-new"}; !reflect.DeepEqual(sums, want) {
+		t.Errorf("merged checksums = %v, want %v", sums, want)
+	}
+	if merged.Host != "laptop" {
+		t.Errorf("merged host = %q, want laptop", merged.Host)
+	}
+
+	// A real conflict aborts the rebase and keeps the local commit
+	runGit(t, other, "pull", "--quiet", "--rebase")
+	commitFiles(t, other, map[string]string{"zsh/.zshrc": "other\n"})
+	runGit(t, other, "push", "--quiet")
+	commitFiles(t, repo, map[string]string{"zsh/.zshrc": "local again\n"})
+	head := runGit(t, repo, "rev-parse", "HEAD")
+	var diverged *DivergedError
+	if err := sync(SyncRebase, repo, "laptop", &backup.Result{}); !errors.As(err, &diverged) || !reflect.DeepEqual(diverged.Conflicts, []string{"zsh/.zshrc"}) {
+		t.Errorf("sync() error = %v, want a DivergedError for zsh/.zshrc", err)
+	}
+	if rebaseInProgress(repo) || runGit(t, repo, "rev-parse", "HEAD") != head {
+		t.Error("sync() didn't put the local commits back after the conflict")
+	}
+}
+
+func TestSyncRebasePullFails(t *testing.T) {
+	repo, remote := newTestRepo(t)
+	commitFiles(t, repo, map[string]string{"zsh/.zshrc": "local\n"})
+	if err := os.RemoveAll(remote); err != nil {
+		t.Fatal(err)
+	}
+	err := sync(SyncRebase, repo, "laptop", &backup.Result{})
+	if err == nil || !strings.Contains(err.Error(), "git pull --rebase failed: exit status") {
+		t.Errorf("sync() error = %v, want the pull error", err)
+	}
+}
+
+func TestSyncFetchCheckDiverged(t *testing.T) {
+	repo, remote := newTestRepo(t)
+	other := cloneRemote(t, remote)
+	commitFiles(t, other, map[string]string{"zsh/.zshrc": "other\n", "git/.gitconfig": "other\n"})
+	runGit(t, other, "push", "--quiet")
+
+	commitFiles(t, repo, map[string]string{"zsh/.zshrc": "local\n"})
+	result := &backup.Result{Apps: []backup.AppResult{{Name: "zsh", Added: []string{".zshrc"}}}}
+	var diverged *DivergedError
+	err := sync(SyncFetchCheck, repo, "laptop", result)
+	if !errors.As(err, &diverged) {
+		t.Fatalf("sync() error = %v, want a DivergedError", err)
+	}
+	if diverged.Behind != 1 || !reflect.DeepEqual(diverged.Conflicts, []string{"zsh/.zshrc"}) {
+		t.Errorf("sync() = %+v, want 1 commit behind with zsh/.zshrc in conflict", diverged)
+	}
+	if got := runGit(t, remote, "rev-parse", "main"); got != runGit(t, other, "rev-parse", "HEAD") {
+		t.Error("sync() pushed despite the remote having moved on")
+	}
+
+	// Once caught up, it pushes
+	runGit(t, repo, "reset", "--quiet", "--hard", "origin/main")
+	commitFiles(t, repo, map[string]string{"nvim/init.lua": "local\n"})
+	if err := sync(SyncFetchCheck, repo, "laptop", result); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	if got, want := runGit(t, remote, "rev-parse", "main"), runGit(t, repo, "rev-parse", "HEAD"); got != want {
+		t.Errorf("remote main = %s, want %s", got, want)
+	}
+}
+
+func TestSyncHostBranch(t *testing.T) {
+	repo, remote := newTestRepo(t)
+	mainHead := runGit(t, remote, "rev-parse", "main")
+	commitFiles(t, repo, map[string]string{"zsh/.zshrc": "local\n"})
+	if err := sync(SyncHostBranch, repo, "laptop", &backup.Result{}); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	if got, want := runGit(t, remote, "rev-parse", HostBranch("laptop")), runGit(t, repo, "rev-parse", "HEAD"); got != want {
+		t.Errorf("remote %s = %s, want %s", HostBranch("laptop"), got, want)
+	}
+	if got := runGit(t, remote, "rev-parse", "main"); got != mainHead {
+		t.Error("sync() moved main")
+	}
+}
@@ -14,6 +14,10 @@ Commands:
   add             Add a file or folder to an app in the config.
   backup          Copy all configured files into the backup_dir and commit to Git.
   restore         Restore files from backup to their original locations.
+  status          Show which files differ between their live location and the backup.
+  diff            Show unified diffs between live files and their backed-up copies.
+  log             Show the backup history of an app or a file.
+  verify          Check the files in backup_dir against the checksums recorded at backup time.
 
 Use "gitbak <command> --help" for more information about a command.
 
@@ -24,5 +28,13 @@ Global Flags:
 Examples:
   gitbak add --path /path/to/file --app myapp
   gitbak restore --app ssh    # Only restore SSH configuration
-  gitbak restore             # Restore all configured apps`)
+  gitbak restore             # Restore all configured apps
+  gitbak restore --on-conflict=backup   # Never prompt; move existing files aside
+  gitbak restore --app git --at 2026-09-01   # Restore git config as it was on that date
+  gitbak restore --rollback 20261017-093012  # Undo a restore, using the journal id it printed
+  gitbak status --app nvim   # Exits non-zero if nvim has changed since the last backup
+  gitbak diff ~/.zshrc       # Show what changed in .zshrc since the last backup
+  gitbak verify              # Check the backup for corruption before restoring from it
+  gitbak backup --allow-secrets   # Commit even though the secret scan found something
+  gitbak restore --profile linux  # Apply the path overrides of the "linux" profile`)
 }
@@ -0,0 +1,103 @@
+package history
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kennyparsons/gitbak/backup"
+	"github.com/kennyparsons/gitbak/config"
+	"github.com/kennyparsons/gitbak/git"
+	"github.com/kennyparsons/gitbak/internal/utils"
+)
+
+// Log prints the backup history, newest first, showing the date, commit hash
+// and files changed by each commit. If appName is not empty, only commits
+// touching that app are shown; if path is not empty, only commits touching the
+// backup of that original source path are shown.
+func Log(cfg *config.Config, appName, path string, limit int, overrides []utils.PathOverride) error {
+	var pathspecs []string
+
+	if appName != "" {
+		if _, ok := cfg.CustomApps[appName]; !ok {
+			return fmt.Errorf("app %s not found in config", appName)
+		}
+		pathspecs = append(pathspecs, appName)
+	}
+
+	if path != "" {
+		backupPath, err := backupPathFor(cfg, appName, utils.ExpandPath(path, overrides), overrides)
+		if err != nil {
+			return err
+		}
+		pathspecs = []string{backupPath}
+	}
+
+	entries, err := git.Log(cfg.BackupDir, pathspecs, limit)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("No backups found")
+		return nil
+	}
+
+	for _, e := range entries {
+		fmt.Printf("%s  %s  %s\n", e.Hash[:12], e.Date.Local().Format("2006-01-02 15:04:05"), e.Subject)
+		for _, f := range e.Files {
+			if f.Path == backup.MetadataFileName {
+				continue
+			}
+			if len(pathspecs) > 0 && !matchesAny(f.Path, pathspecs) {
+				continue
+			}
+			fmt.Printf("    %s  %s\n", f.Status, f.Path)
+		}
+	}
+	return nil
+}
+
+// backupPathFor maps a live source path to its location in the backup,
+// relative to backup_dir: backup_dir/<app>/<basename of app path>/<rest>.
+// The path may be an app path itself or anything below one. When app paths
+// overlap, the most specific one wins, and apps are tried in name order so
+// the answer is the same every time.
+func backupPathFor(cfg *config.Config, appName, path string, overrides []utils.PathOverride) (string, error) {
+	var names []string
+	for name := range cfg.CustomApps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	best, bestLen := "", -1
+	for _, name := range names {
+		if appName != "" && name != appName {
+			continue
+		}
+		for _, rawPath := range cfg.CustomApps[name].Paths {
+			srcPath := utils.ExpandPath(rawPath, overrides)
+			rel, err := filepath.Rel(srcPath, path)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue
+			}
+			if len(srcPath) > bestLen {
+				best, bestLen = filepath.ToSlash(filepath.Join(name, filepath.Base(srcPath), rel)), len(srcPath)
+			}
+		}
+	}
+	if bestLen < 0 {
+		return "", fmt.Errorf("%s is not covered by any configured app", path)
+	}
+	return best, nil
+}
+
+// matchesAny reports whether path is one of pathspecs or lies below one
+func matchesAny(path string, pathspecs []string) bool {
+	for _, p := range pathspecs {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package history
+
+import (
+	"testing"
+
+	"github.com/kennyparsons/gitbak/config"
+)
+
+func TestBackupPathFor(t *testing.T) {
+	cfg := &config.Config{
+		CustomApps: map[string]config.AppConfig{
+			"zsh":  {Paths: []string{"/home/test/.zshrc"}},
+			"nvim": {Paths: []string{"/home/test/.config/nvim"}},
+			// Overlaps nvim, which is more specific
+			"config": {Paths: []string{"/home/test/.config"}},
+			"a-copy": {Paths: []string{"/home/test/.config"}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "app path file", path: "/home/test/.zshrc", want: "zsh/.zshrc"},
+		{name: "app path directory", path: "/home/test/.config/nvim", want: "nvim/nvim"},
+		{name: "file inside directory", path: "/home/test/.config/nvim/lua/init.lua", want: "nvim/nvim/lua/init.lua"},
+		{name: "overlapping apps", path: "/home/test/.config/git/config", want: "a-copy/.config/git/config"},
+		{name: "name starting with dots", path: "/home/test/.config/nvim/..lua", want: "nvim/nvim/..lua"},
+		{name: "not covered", path: "/home/test/.bashrc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := backupPathFor(cfg, "", tt.path, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("backupPathFor(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("backupPathFor(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/kennyparsons/gitbak/internal/utils"
+)
+
+// Files are sealed with AES-256-GCM under a key derived from a passphrase with
+// PBKDF2-HMAC-SHA256. The salt and iteration count live in the backup
+// directory, so any machine with the passphrase can decrypt a clone. An
+// encrypted file is Header, a 12-byte nonce and the ciphertext with its tag.
+//
+// The nonce is an HMAC of the plaintext, so encrypting the same contents twice
+// gives the same bytes: unchanged files don't show up as changes in git, and
+// distinct contents never share a nonce.
+
+// Header starts every encrypted file
+const Header = "gitbak-encrypted-v1\n"
+
+// Overhead is how much larger an encrypted file is than its plaintext
+const Overhead = len(Header) + nonceSize + tagSize
+
+// ParamsFileName is the file in the backup directory holding the key
+// derivation parameters
+const ParamsFileName = ".gitbak_encryption.json"
+
+// PassphraseEnv is read for the passphrase when no key file is configured
+const PassphraseEnv = "GITBAK_PASSPHRASE"
+
+const (
+	nonceSize  = 12
+	tagSize    = 16
+	saltSize   = 16
+	iterations = 600000
+)
+
+// ErrNoPassphrase is returned when neither a key file nor PassphraseEnv is set
+var ErrNoPassphrase = errors.New("no encryption passphrase: set encryption_key_file in the config or " + PassphraseEnv)
+
+// params are the key derivation parameters stored in ParamsFileName
+type params struct {
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       string `json:"salt"`  // Base64-encoded
+	Check      string `json:"check"` // HMAC proving a passphrase is the right one, base64-encoded
+}
+
+// Key encrypts and decrypts the files of a backup directory
+type Key struct {
+	params   params
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// Passphrase reads the passphrase from keyFile, or from PassphraseEnv if
+// keyFile is empty. A trailing newline in the file is ignored.
+func Passphrase(keyFile string) ([]byte, error) {
+	if keyFile == "" {
+		if p := os.Getenv(PassphraseEnv); p != "" {
+			return []byte(p), nil
+		}
+		return nil, ErrNoPassphrase
+	}
+	data, err := os.ReadFile(utils.ExpandPath(keyFile, nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key file: %v", err)
+	}
+	data = bytes.TrimRight(data, "\r\n")
+	if len(data) == 0 {
+		return nil, fmt.Errorf("encryption key file %s is empty", keyFile)
+	}
+	return data, nil
+}
+
+// NewKey derives a key from passphrase with a fresh salt. Call Save to store
+// its parameters in the backup directory.
+func NewKey(passphrase []byte) (*Key, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	p := params{KDF: "pbkdf2-sha256", Iterations: iterations, Salt: base64.StdEncoding.EncodeToString(salt)}
+	k, check, err := deriveKey(passphrase, p)
+	if err != nil {
+		return nil, err
+	}
+	k.params.Check = base64.StdEncoding.EncodeToString(check)
+	return k, nil
+}
+
+// LoadKey derives the key of the backup directory dir from passphrase. It
+// returns an error satisfying os.IsNotExist if dir has no parameters yet, and
+// an error if passphrase is not the one the parameters were created with.
+func LoadKey(dir string, passphrase []byte) (*Key, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ParamsFileName))
+	if err != nil {
+		return nil, err
+	}
+	var p params
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", ParamsFileName, err)
+	}
+	if p.KDF != "pbkdf2-sha256" || p.Iterations <= 0 {
+		return nil, fmt.Errorf("unsupported key derivation %q in %s", p.KDF, ParamsFileName)
+	}
+
+	k, check, err := deriveKey(passphrase, p)
+	if err != nil {
+		return nil, err
+	}
+	want, err := base64.StdEncoding.DecodeString(p.Check)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", ParamsFileName, err)
+	}
+	if !hmac.Equal(check, want) {
+		return nil, fmt.Errorf("wrong encryption passphrase for this backup")
+	}
+	return k, nil
+}
+
+// deriveKey derives a key and its check value from passphrase
+func deriveKey(passphrase []byte, p params) (*Key, []byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(p.Salt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse salt: %v", err)
+	}
+	master := pbkdf2(passphrase, salt, p.Iterations, 32)
+
+	block, err := aes.NewCipher(subkey(master, "gitbak encryption key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	k := &Key{params: p, aead: aead, nonceKey: subkey(master, "gitbak nonce key")}
+	return k, subkey(master, "gitbak key check"), nil
+}
+
+// subkey derives an independent key for purpose from master
+func subkey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Save writes the key's parameters to the backup directory dir
+func (k *Key) Save(dir string) error {
+	data, err := json.MarshalIndent(k.params, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(filepath.Join(dir, ParamsFileName), bytes.NewReader(append(data, '\n')), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", ParamsFileName, err)
+	}
+	return nil
+}
+
+// Encrypt seals plaintext into the encrypted file format
+func (k *Key) Encrypt(plaintext []byte) []byte {
+	mac := hmac.New(sha256.New, k.nonceKey)
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:nonceSize]
+
+	out := make([]byte, 0, len(plaintext)+Overhead)
+	out = append(out, Header...)
+	out = append(out, nonce...)
+	return k.aead.Seal(out, nonce, plaintext, []byte(Header))
+}
+
+// Decrypt opens a file in the encrypted file format
+func (k *Key) Decrypt(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) || len(data) < Overhead {
+		return nil, fmt.Errorf("not an encrypted file")
+	}
+	nonce := data[len(Header) : len(Header)+nonceSize]
+	plaintext, err := k.aead.Open(nil, nonce, data[len(Header)+nonceSize:], []byte(Header))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: file is corrupt or was encrypted with another passphrase")
+	}
+	return plaintext, nil
+}
+
+// IsEncrypted reports whether data is in the encrypted file format
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Header))
+}
+
+// KeyLoader loads the key of a backup directory the first time an encrypted
+// file needs it, so commands only ask for a passphrase when there is
+// something to decrypt
+type KeyLoader struct {
+	Dir     string // Backup directory holding ParamsFileName
+	KeyFile string // encryption_key_file from the config
+
+	once sync.Once
+	key  *Key
+	err  error
+}
+
+// Key returns the key, loading it on first use
+func (l *KeyLoader) Key() (*Key, error) {
+	l.once.Do(func() {
+		passphrase, err := Passphrase(l.KeyFile)
+		if err != nil {
+			l.err = err
+			return
+		}
+		l.key, l.err = LoadKey(l.Dir, passphrase)
+		if os.IsNotExist(l.err) {
+			l.err = fmt.Errorf("backup has encrypted files but no %s", ParamsFileName)
+		}
+	})
+	return l.key, l.err
+}
+
+// ReadFile reads a file from the backup directory, decrypting it with a key
+// from keys if it is encrypted
+func ReadFile(path string, keys *KeyLoader) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || !IsEncrypted(data) {
+		return data, err
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("%s is encrypted", path)
+	}
+	key, err := keys.Key()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := key.Decrypt(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", strings.TrimPrefix(path, keys.Dir+string(filepath.Separator)), err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,67 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// Test vectors for PBKDF2-HMAC-SHA256 from RFC 7914, section 11
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2([]byte(tt.password), []byte(tt.salt), tt.iterations, 64))
+		if got != tt.want {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	dir := t.TempDir()
+	key, err := NewKey([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := []byte("[default]\naws_secret_access_key = abc\n")
+	sealed := key.Encrypt(plaintext)
+	if len(sealed) != len(plaintext)+Overhead || !IsEncrypted(sealed) {
+		t.Fatalf("Encrypt() returned %d bytes, want %d with header", len(sealed), len(plaintext)+Overhead)
+	}
+	if bytes.Contains(sealed, []byte("aws_secret_access_key")) {
+		t.Fatal("Encrypt() output contains the plaintext")
+	}
+	if again := key.Encrypt(plaintext); !bytes.Equal(again, sealed) {
+		t.Error("Encrypt() is not deterministic, unchanged files would churn in git")
+	}
+
+	// A clone of the backup decrypts with the same passphrase
+	loaded, err := LoadKey(dir, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("LoadKey() error = %v", err)
+	}
+	got, err := loaded.Decrypt(sealed)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("Decrypt() = %q, %v, want %q", got, err, plaintext)
+	}
+
+	if _, err := LoadKey(dir, []byte("wrong")); err == nil {
+		t.Error("LoadKey() accepted a wrong passphrase")
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := loaded.Decrypt(sealed); err == nil {
+		t.Error("Decrypt() accepted a tampered file")
+	}
+}
@@ -0,0 +1,278 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Key paths join the keys leading to a value with dots, with sequence items
+// numbered from 0: "auths.https://index.docker.io/v1/.auth" in JSON,
+// "users.0.user.token" in YAML and "section.key" in INI files. Only the
+// files' text is looked at, never re-encoded, so the backup keeps the
+// formatting and comments of the original.
+
+// keySpans returns the offsets of the values whose key path matches key in
+// data, reading it as JSON, YAML or INI depending on the extension of path
+func keySpans(data []byte, path string, key *regexp.Regexp) ([][2]int, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return jsonSpans(data, key)
+	case ".yaml", ".yml":
+		return yamlSpans(data, key), nil
+	default:
+		return iniSpans(data, key), nil
+	}
+}
+
+// jsonSpans finds string values in a JSON document. The offsets exclude the
+// quotes, so placeholders keep the document valid.
+func jsonSpans(data []byte, key *regexp.Regexp) ([][2]int, error) {
+	type frame struct {
+		object  bool
+		key     string
+		index   int
+		wantKey bool
+	}
+	var stack []*frame
+	var spans [][2]int
+
+	path := func() string {
+		segments := make([]string, len(stack))
+		for i, f := range stack {
+			if f.object {
+				segments[i] = f.key
+			} else {
+				segments[i] = index(f.index)
+			}
+		}
+		return joinPath(segments)
+	}
+	// afterValue moves the innermost container on to its next element
+	afterValue := func() {
+		if len(stack) == 0 {
+			return
+		}
+		if top := stack[len(stack)-1]; top.object {
+			top.wantKey = true
+		} else {
+			top.index++
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		start := dec.InputOffset()
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("not valid JSON: %v", err)
+		}
+		end := dec.InputOffset()
+
+		if len(stack) > 0 && stack[len(stack)-1].wantKey {
+			if tok == json.Delim('}') {
+				stack = stack[:len(stack)-1]
+				afterValue()
+				continue
+			}
+			top := stack[len(stack)-1]
+			top.key, top.wantKey = tok.(string), false
+			continue
+		}
+
+		switch v := tok.(type) {
+		case json.Delim:
+			switch v {
+			case '{':
+				stack = append(stack, &frame{object: true, wantKey: true})
+			case '[':
+				stack = append(stack, &frame{})
+			default:
+				stack = stack[:len(stack)-1]
+				afterValue()
+			}
+		case string:
+			if key.MatchString(path()) {
+				// The token is the last thing before end, a quoted string
+				quote := bytes.IndexByte(data[start:end], '"')
+				spans = append(spans, [2]int{int(start) + quote + 1, int(end) - 1})
+			}
+			afterValue()
+		default:
+			afterValue()
+		}
+	}
+	return spans, nil
+}
+
+// yamlFrame is a mapping key or sequence item enclosing a YAML line
+type yamlFrame struct {
+	indent  int
+	segment string
+	item    bool // A sequence item, numbered in segment
+	items   int  // Sequence items seen directly below this frame
+}
+
+// yamlSpans finds scalar values in block-style YAML: "key: value" mappings
+// nested by indentation and "- " sequences. Flow collections and multi-line
+// scalars are not looked into.
+func yamlSpans(data []byte, key *regexp.Regexp) [][2]int {
+	var stack []*yamlFrame
+	root := &yamlFrame{indent: -1}
+	var spans [][2]int
+
+	// pop leaves only the frames that enclose a line at indent
+	pop := func(indent int, keepParentKey bool) {
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			// A sequence may sit at the same indentation as its key
+			if top.indent < indent || (keepParentKey && top.indent == indent && !top.item) {
+				return
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	path := func() string {
+		segments := make([]string, len(stack))
+		for i, f := range stack {
+			segments[i] = f.segment
+		}
+		return joinPath(segments)
+	}
+
+	offset := 0
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		lineStart := offset
+		offset += len(line)
+		content := strings.TrimRight(line, "\r\n")
+		trimmed := strings.TrimLeft(content, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		indent := len(content) - len(trimmed)
+
+		// Each "- " opens a numbered item, and what follows it sits further in
+		item := false
+		for trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			pop(indent, true)
+			parent := root
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+			}
+			stack = append(stack, &yamlFrame{indent: indent, segment: index(parent.items), item: true})
+			parent.items++
+			item = true
+			trimmed = strings.TrimLeft(strings.TrimPrefix(trimmed, "-"), " ")
+			indent = len(content) - len(trimmed)
+		}
+		if trimmed == "" {
+			continue
+		}
+		if !item {
+			pop(indent, false)
+		}
+
+		colon := strings.Index(trimmed, ": ")
+		if colon < 0 && strings.HasSuffix(trimmed, ":") {
+			colon = len(trimmed) - 1
+		}
+		base := lineStart + len(content) - len(trimmed)
+		if colon <= 0 {
+			// A plain sequence item
+			if item && key.MatchString(path()) {
+				if s, e, ok := yamlValue(trimmed); ok {
+					spans = append(spans, [2]int{base + s, base + e})
+				}
+			}
+			continue
+		}
+
+		k := strings.TrimSpace(trimmed[:colon])
+		if s, e := unquote(k); e-s != len(k) {
+			k = k[s:e]
+		}
+		stack = append(stack, &yamlFrame{indent: indent, segment: k})
+
+		valueText := strings.TrimLeft(trimmed[colon+1:], " ")
+		if valueText == "" || valueText[0] == '#' || valueText[0] == '|' || valueText[0] == '>' {
+			continue
+		}
+		if key.MatchString(path()) {
+			if s, e, ok := yamlValue(valueText); ok {
+				valueStart := lineStart + len(content) - len(valueText)
+				spans = append(spans, [2]int{valueStart + s, valueStart + e})
+			}
+		}
+	}
+	return spans
+}
+
+// yamlValue returns the offsets of a scalar within text, leaving out quotes
+// and a trailing comment. Flow collections are not scalars.
+func yamlValue(text string) (int, int, bool) {
+	if text == "" || text[0] == '{' || text[0] == '[' || text[0] == '&' || text[0] == '*' {
+		return 0, 0, false
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		if end := strings.IndexByte(text[1:], text[0]); end >= 0 {
+			return 1, end + 1, true
+		}
+		return 0, 0, false
+	}
+	end := len(text)
+	if i := strings.Index(text, " #"); i >= 0 {
+		end = i
+	}
+	end = len(strings.TrimRight(text[:end], " \t"))
+	return 0, end, end > 0
+}
+
+// iniSpans finds values in INI-style files: "key = value" lines, grouped
+// under "[section]" headers. Keys outside of any section have no prefix.
+func iniSpans(data []byte, key *regexp.Regexp) [][2]int {
+	var spans [][2]int
+	section := ""
+	offset := 0
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		lineStart := offset
+		offset += len(line)
+		content := strings.TrimRight(line, "\r\n")
+		trimmed := strings.TrimSpace(content)
+		if trimmed == "" || trimmed[0] == '#' || trimmed[0] == ';' {
+			continue
+		}
+		if trimmed[0] == '[' && trimmed[len(trimmed)-1] == ']' {
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			continue
+		}
+
+		eq := strings.IndexByte(content, '=')
+		if eq < 0 {
+			continue
+		}
+		k := strings.TrimSpace(content[:eq])
+		path := k
+		if section != "" {
+			path = section + "." + k
+		}
+		if !key.MatchString(path) {
+			continue
+		}
+
+		value := content[eq+1:]
+		valueStart := eq + 1 + len(value) - len(strings.TrimLeft(value, " \t"))
+		value = strings.TrimSpace(value)
+		s, e := unquote(value)
+		if e > s {
+			spans = append(spans, [2]int{lineStart + valueStart + s, lineStart + valueStart + e})
+		}
+	}
+	return spans
+}
@@ -0,0 +1,292 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/kennyparsons/gitbak/config"
+	"github.com/kennyparsons/gitbak/internal/utils"
+)
+
+// Redaction replaces secret values in backed-up files with placeholders like
+// {{gitbak-secret:NPM_TOKEN}}. The values themselves go to a secrets file on
+// the machine that was backed up, and restore puts them back from there or
+// from GITBAK_SECRET_<NAME> environment variables.
+
+// DefaultSecretsFile is where redacted values are kept unless secrets_file is
+// set in the config
+const DefaultSecretsFile = "~/.config/gitbak/secrets.json"
+
+// EnvPrefix starts the names of environment variables holding secret values
+const EnvPrefix = "GITBAK_SECRET_"
+
+var placeholderPattern = regexp.MustCompile(`\{\{gitbak-secret:([A-Za-z0-9_.-]+)\}\}`)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Rule is a compiled redact rule
+type Rule struct {
+	Name    string
+	files   string
+	pattern *regexp.Regexp
+	key     *regexp.Regexp
+}
+
+// Compile checks and compiles the redact rules of an app
+func Compile(rules []config.RedactRule) ([]Rule, error) {
+	var compiled []Rule
+	for i, r := range rules {
+		if !namePattern.MatchString(r.Name) {
+			return nil, fmt.Errorf("redact rule %d: name %q must be made of letters, digits, '_', '-' and '.'", i+1, r.Name)
+		}
+		if r.Files == "" {
+			return nil, fmt.Errorf("redact rule %s: files is required", r.Name)
+		}
+		if (r.Pattern == "") == (r.Key == "") {
+			return nil, fmt.Errorf("redact rule %s: set either pattern or key", r.Name)
+		}
+		if !doublestar.ValidatePattern(r.Files) {
+			return nil, fmt.Errorf("redact rule %s: invalid files pattern %q", r.Name, r.Files)
+		}
+
+		c := Rule{Name: r.Name, files: r.Files}
+		if r.Pattern != "" {
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("redact rule %s: invalid pattern: %v", r.Name, err)
+			}
+			c.pattern = re
+		} else {
+			c.key = keyPathPattern(r.Key)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// keyPathPattern turns a key path, where "*" stands for any run of
+// characters, into a regex over the dotted paths of values in a file
+func keyPathPattern(key string) *regexp.Regexp {
+	parts := strings.Split(key, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// ForFile returns the rules that apply to the file at path
+func ForFile(rules []Rule, path string) []Rule {
+	path = filepath.ToSlash(path)
+	var matched []Rule
+	for _, r := range rules {
+		pattern := r.files
+		if !strings.HasPrefix(pattern, "/") {
+			pattern = "**/" + pattern
+		}
+		if ok, _ := doublestar.Match(pattern, path); ok {
+			matched = append(matched, r)
+		}
+	}
+	return matched
+}
+
+// span is a secret value at data[start:end], to be replaced by name
+type span struct {
+	start, end int
+	name       string
+}
+
+// Apply replaces the values the rules pick out of data, the contents of the
+// file at path, with placeholders. It returns the redacted contents and the
+// values by name. A rule matching several values names them NAME, NAME_2,
+// NAME_3 and so on, in the order they appear.
+func Apply(data []byte, path string, rules []Rule) ([]byte, map[string]string, error) {
+	var spans []span
+	for _, r := range rules {
+		var found [][2]int
+		if r.pattern != nil {
+			for _, m := range r.pattern.FindAllSubmatchIndex(data, -1) {
+				if len(m) >= 4 && m[2] >= 0 {
+					found = append(found, [2]int{m[2], m[3]})
+				} else {
+					found = append(found, [2]int{m[0], m[1]})
+				}
+			}
+		} else {
+			var err error
+			if found, err = keySpans(data, path, r.key); err != nil {
+				return nil, nil, fmt.Errorf("redact rule %s: %v", r.Name, err)
+			}
+		}
+
+		n := 0
+		for _, f := range found {
+			value := data[f[0]:f[1]]
+			// Empty values and placeholders a restore couldn't fill have
+			// nothing to hide
+			if len(value) == 0 || placeholderPattern.Match(value) {
+				continue
+			}
+			n++
+			name := r.Name
+			if n > 1 {
+				name = fmt.Sprintf("%s_%d", r.Name, n)
+			}
+			spans = append(spans, span{start: f[0], end: f[1], name: name})
+		}
+	}
+	if len(spans) == 0 {
+		return data, nil, nil
+	}
+
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	var out bytes.Buffer
+	values := make(map[string]string)
+	last := 0
+	for _, s := range spans {
+		if s.start < last {
+			// Already covered by an earlier rule
+			continue
+		}
+		out.Write(data[last:s.start])
+		out.WriteString(Placeholder(s.name))
+		values[s.name] = string(data[s.start:s.end])
+		last = s.end
+	}
+	out.Write(data[last:])
+	return out.Bytes(), values, nil
+}
+
+// Placeholder returns the text standing in for the secret called name
+func Placeholder(name string) string {
+	return "{{gitbak-secret:" + name + "}}"
+}
+
+// Names returns the sorted names of values
+func Names(values map[string]string) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Fill puts the secret values back into data. Values are looked up in the
+// environment first, then in store. It returns the names it found no value
+// for, whose placeholders are left in place.
+func Fill(data []byte, store map[string]string) ([]byte, []string) {
+	var missing []string
+	filled := placeholderPattern.ReplaceAllFunc(data, func(m []byte) []byte {
+		name := string(placeholderPattern.FindSubmatch(m)[1])
+		if value, ok := Lookup(name, store); ok {
+			return []byte(value)
+		}
+		missing = append(missing, name)
+		return m
+	})
+	return filled, missing
+}
+
+// Lookup returns the value of the secret called name from the environment
+// or store
+func Lookup(name string, store map[string]string) (string, bool) {
+	if value, ok := os.LookupEnv(EnvVar(name)); ok {
+		return value, true
+	}
+	value, ok := store[name]
+	return value, ok
+}
+
+// EnvVar returns the environment variable that can hold the secret called
+// name, e.g. GITBAK_SECRET_NPM_TOKEN
+func EnvVar(name string) string {
+	return EnvPrefix + strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, name)
+}
+
+// StorePath returns the secrets file set in cfg, or DefaultSecretsFile
+func StorePath(cfg *config.Config) string {
+	if cfg.SecretsFile != "" {
+		return cfg.SecretsFile
+	}
+	return DefaultSecretsFile
+}
+
+// LoadStore reads the secrets file. A missing file is an empty store.
+func LoadStore(path string) (map[string]string, error) {
+	store := make(map[string]string)
+	data, err := os.ReadFile(utils.ExpandPath(path, nil))
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read secrets file: %v", err)
+	}
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, fmt.Errorf("failed to parse secrets file: %v", err)
+	}
+	return store, nil
+}
+
+// SaveStore adds values to the secrets file, readable only by the user
+func SaveStore(path string, values map[string]string) error {
+	store, err := LoadStore(path)
+	if err != nil {
+		return err
+	}
+	changed := false
+	for name, value := range values {
+		if store[name] != value {
+			store[name] = value
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+	path = utils.ExpandPath(path, nil)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create secrets file directory: %v", err)
+	}
+	if err := utils.WriteFileAtomic(path, bytes.NewReader(append(data, '\n')), 0600); err != nil {
+		return fmt.Errorf("failed to write secrets file: %v", err)
+	}
+	return nil
+}
+
+// unquote strips matching quotes around a value, returning the offsets of
+// what's inside them relative to value
+func unquote(value string) (int, int) {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return 1, len(value) - 1
+	}
+	return 0, len(value)
+}
+
+// joinPath joins the segments of a key path with dots
+func joinPath(segments []string) string {
+	return strings.Join(segments, ".")
+}
+
+// index formats a sequence index as a key path segment
+func index(i int) string {
+	return strconv.Itoa(i)
+}
@@ -0,0 +1,123 @@
+package redact
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kennyparsons/gitbak/config"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		rule  config.RedactRule
+		input string
+		want  string
+		vals  map[string]string
+	}{
+		{
+			name:  "pattern with group",
+			path:  "/home/me/.npmrc",
+			rule:  config.RedactRule{Name: "NPM", Files: ".npmrc", Pattern: `_authToken=(\S+)`},
+			input: "registry=https://registry.npmjs.org/\n//registry.npmjs.org/:_authToken=npm_abc\n//npm.corp/:_authToken=npm_def\n",
+			want:  "registry=https://registry.npmjs.org/\n//registry.npmjs.org/:_authToken={{gitbak-secret:NPM}}\n//npm.corp/:_authToken={{gitbak-secret:NPM_2}}\n",
+			vals:  map[string]string{"NPM": "npm_abc", "NPM_2": "npm_def"},
+		},
+		{
+			name: "JSON key path",
+			path: "/home/me/.docker/config.json",
+			rule: config.RedactRule{Name: "DOCKER", Files: ".docker/config.json", Key: "auths.*.auth"},
+			input: `{
+  "auths": {
+    "https://index.docker.io/v1/": {"auth": "dXNlcjpwYXNz", "email": "me@example.com"}
+  },
+  "credsStore": "desktop"
+}`,
+			want: `{
+  "auths": {
+    "https://index.docker.io/v1/": {"auth": "{{gitbak-secret:DOCKER}}", "email": "me@example.com"}
+  },
+  "credsStore": "desktop"
+}`,
+			vals: map[string]string{"DOCKER": "dXNlcjpwYXNz"},
+		},
+		{
+			name:  "YAML mapping",
+			path:  "/home/me/.config/gh/hosts.yml",
+			rule:  config.RedactRule{Name: "GH", Files: "gh/hosts.yml", Key: "*.oauth_token"},
+			input: "github.com:\n    user: me\n    oauth_token: gho_secret # keep this comment\n    git_protocol: ssh\n",
+			want:  "github.com:\n    user: me\n    oauth_token: {{gitbak-secret:GH}} # keep this comment\n    git_protocol: ssh\n",
+			vals:  map[string]string{"GH": "gho_secret"},
+		},
+		{
+			name:  "YAML sequence",
+			path:  "/home/me/.kube/config.yaml",
+			rule:  config.RedactRule{Name: "KUBE", Files: "config.yaml", Key: "users.1.user.token"},
+			input: "users:\n- name: dev\n  user:\n    token: one\n- name: prod\n  user:\n    token: \"two\"\n",
+			want:  "users:\n- name: dev\n  user:\n    token: one\n- name: prod\n  user:\n    token: \"{{gitbak-secret:KUBE}}\"\n",
+			vals:  map[string]string{"KUBE": "two"},
+		},
+		{
+			name:  "INI section",
+			path:  "/home/me/.aws/credentials",
+			rule:  config.RedactRule{Name: "AWS", Files: ".aws/credentials", Key: "default.aws_secret_access_key"},
+			input: "[default]\naws_access_key_id = AKIA\naws_secret_access_key = s3cr3t\n[other]\naws_secret_access_key = nope\n",
+			want:  "[default]\naws_access_key_id = AKIA\naws_secret_access_key = {{gitbak-secret:AWS}}\n[other]\naws_secret_access_key = nope\n",
+			vals:  map[string]string{"AWS": "s3cr3t"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := Compile([]config.RedactRule{tt.rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ForFile(rules, tt.path)) != 1 {
+				t.Fatalf("rule doesn't apply to %s", tt.path)
+			}
+			got, vals, err := Apply([]byte(tt.input), tt.path, rules)
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Apply() =\n%s\nwant\n%s", got, tt.want)
+			}
+			if !reflect.DeepEqual(vals, tt.vals) {
+				t.Errorf("Apply() values = %v, want %v", vals, tt.vals)
+			}
+
+			filled, missing := Fill(got, vals)
+			if string(filled) != tt.input || len(missing) != 0 {
+				t.Errorf("Fill() = %q, missing %v, want the original", filled, missing)
+			}
+		})
+	}
+}
+
+func TestFillFromEnvironment(t *testing.T) {
+	t.Setenv("GITBAK_SECRET_NPM_TOKEN", "from-env")
+	got, missing := Fill([]byte("a={{gitbak-secret:npm-token}} b={{gitbak-secret:OTHER}}"), map[string]string{"npm-token": "from-store"})
+	if string(got) != "a=from-env b={{gitbak-secret:OTHER}}" {
+		t.Errorf("Fill() = %q", got)
+	}
+	if !reflect.DeepEqual(missing, []string{"OTHER"}) {
+		t.Errorf("Fill() missing = %v, want [OTHER]", missing)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, r := range []config.RedactRule{
+		{Files: ".npmrc", Pattern: "x"},
+		{Name: "A B", Files: ".npmrc", Pattern: "x"},
+		{Name: "A", Pattern: "x"},
+		{Name: "A", Files: ".npmrc"},
+		{Name: "A", Files: ".npmrc", Pattern: "x", Key: "y"},
+		{Name: "A", Files: ".npmrc", Pattern: "("},
+	} {
+		if _, err := Compile([]config.RedactRule{r}); err == nil {
+			t.Errorf("Compile(%+v) accepted an invalid rule", r)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes the contents of r to path with the given mode. The
+// data goes to a temporary file in the same directory, which is synced and
+// then renamed over path, so path is either left as it was or fully replaced
+// even if the write fails or the machine crashes halfway. A symlink at path
+// is replaced by the file, not followed.
+func WriteFileAtomic(path string, r io.Reader, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".gitbak-tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	tmpName := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpName)
+		}
+	}()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmpName, err)
+	}
+	// CreateTemp always uses 0600
+	if err := tmp.Chmod(perm); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %v", tmpName, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %v", tmpName, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %v", tmpName, err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+	committed = true
+
+	// Make the rename itself durable; not every platform can sync a
+	// directory, so this is best effort
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
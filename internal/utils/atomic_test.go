@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingReader returns some data and then an error, like a disk going away
+// halfway through a copy
+type failingReader struct{ done bool }
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.done {
+		return 0, errors.New("read failed")
+	}
+	f.done = true
+	return copy(p, "partial"), nil
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".zshrc")
+	if err := os.WriteFile(path, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFileAtomic(path, &failingReader{}, 0600); err == nil {
+		t.Fatal("WriteFileAtomic() with failing reader succeeded")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "original" {
+		t.Errorf("failed write changed the file to %q", data)
+	}
+
+	if err := WriteFileAtomic(path, strings.NewReader("restored"), 0600); err != nil {
+		t.Fatalf("WriteFileAtomic() error = %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "restored" {
+		t.Errorf("file content = %q, want %q", data, "restored")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("file mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+
+	// No temporary files are left behind
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("directory contains %v, want only .zshrc", names)
+	}
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// HostName returns the short name of this machine (the hostname up to the
+// first dot), lower-cased and reduced to characters that are safe in
+// directory and git branch names
+func HostName() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "unknown-host"
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		name = name[:i]
+	}
+	return SanitizeName(name)
+}
+
+// SanitizeName lower-cases name and replaces anything other than letters,
+// digits, '-', '_' and '.' with '-'
+func SanitizeName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '-'
+		}
+	}, name)
+}
+
+// CheckHostName returns an error if the sanitized host name can't be used as
+// a directory or branch name: it is empty or made only of dots, like "..",
+// which would point outside of backup_dir
+func CheckHostName(name string) error {
+	if strings.Trim(name, ".") == "" {
+		return fmt.Errorf("invalid host name %q", name)
+	}
+	return nil
+}
@@ -1,23 +1,34 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/kennyparsons/gitbak/add"
 	"github.com/kennyparsons/gitbak/backup"
 	"github.com/kennyparsons/gitbak/config"
+	"github.com/kennyparsons/gitbak/diff"
 	"github.com/kennyparsons/gitbak/git"
 	"github.com/kennyparsons/gitbak/help"
+	"github.com/kennyparsons/gitbak/history"
 	"github.com/kennyparsons/gitbak/internal/utils"
 	"github.com/kennyparsons/gitbak/restore"
+	"github.com/kennyparsons/gitbak/secrets"
+	"github.com/kennyparsons/gitbak/status"
+	"github.com/kennyparsons/gitbak/verify"
 )
 
 var version = "dev"
 
 func main() {
+	backup.GitbakVersion = version
+
 	// Subcommands
 	addCmd := flag.NewFlagSet("add", flag.ExitOnError)
 	addApp := addCmd.String("app", "", "App name to add the path to (required)")
@@ -27,16 +38,57 @@ func main() {
 	backupCmd := flag.NewFlagSet("backup", flag.ExitOnError)
 	backupDryRun := backupCmd.Bool("dry-run", false, "Print steps without executing")
 	backupNoCommit := backupCmd.Bool("no-commit", false, "Skip git add/commit/push after backup")
+	backupJobs := backupCmd.Int("jobs", 0, "Number of files to copy in parallel (default one per CPU)")
+	backupChecksum := backupCmd.Bool("checksum", false, "Compare file contents to find changes instead of trusting size and modification time")
+	backupAllowSecrets := backupCmd.Bool("allow-secrets", false, "Commit even if files that look like they contain secrets are found")
 	backupConfig := backupCmd.String("config", "~/.config/gitbak/gitbak.json", "Path to config file")
 	var backupOverrides overrideFlags
 	backupCmd.Var(&backupOverrides, "path-override", "Path override in regex=replacement format (can be specified multiple times)")
+	backupProfile := backupCmd.String("profile", "", "Use the path overrides and vars of this profile (default: the profile matching this host)")
 
 	restoreCmd := flag.NewFlagSet("restore", flag.ExitOnError)
 	restoreDryRun := restoreCmd.Bool("dry-run", false, "Print steps without executing")
 	restoreApp := restoreCmd.String("app", "", "Only restore this specific app")
 	restoreConfig := restoreCmd.String("config", "~/.config/gitbak/gitbak.json", "Path to config file")
+	restoreOnConflict := restoreCmd.String("on-conflict", "", "What to do when a file already exists: ask, skip, overwrite, backup, newer or fail (default from config, else ask)")
+	restoreRev := restoreCmd.String("rev", "", "Restore files as of this commit, tag or branch of the backup repository")
+	restoreAt := restoreCmd.String("at", "", "Restore files as of the last backup at or before this date (e.g. 2026-09-01)")
+	restoreFromHost := restoreCmd.String("from-host", "", "Restore the backups of another machine (requires host_layout in the config)")
+	restoreInteractive := restoreCmd.Bool("interactive", false, "Prompt on every conflict, with diff and overwrite/skip all choices")
+	restoreRollback := restoreCmd.String("rollback", "", "Undo an earlier restore, given the journal id it printed")
 	var restoreOverrides overrideFlags
 	restoreCmd.Var(&restoreOverrides, "path-override", "Path override in regex=replacement format (can be specified multiple times)")
+	restoreProfile := restoreCmd.String("profile", "", "Use the path overrides and vars of this profile (default: the profile matching this host)")
+
+	statusCmd := flag.NewFlagSet("status", flag.ExitOnError)
+	statusApp := statusCmd.String("app", "", "Only check this specific app")
+	statusVerbose := statusCmd.Bool("verbose", false, "Also list unchanged files")
+	statusConfig := statusCmd.String("config", "~/.config/gitbak/gitbak.json", "Path to config file")
+	var statusOverrides overrideFlags
+	statusCmd.Var(&statusOverrides, "path-override", "Path override in regex=replacement format (can be specified multiple times)")
+	statusProfile := statusCmd.String("profile", "", "Use the path overrides and vars of this profile (default: the profile matching this host)")
+
+	diffCmd := flag.NewFlagSet("diff", flag.ExitOnError)
+	diffApp := diffCmd.String("app", "", "Only compare this specific app")
+	diffConfig := diffCmd.String("config", "~/.config/gitbak/gitbak.json", "Path to config file")
+	var diffOverrides overrideFlags
+	diffCmd.Var(&diffOverrides, "path-override", "Path override in regex=replacement format (can be specified multiple times)")
+	diffProfile := diffCmd.String("profile", "", "Use the path overrides and vars of this profile (default: the profile matching this host)")
+
+	logCmd := flag.NewFlagSet("log", flag.ExitOnError)
+	logApp := logCmd.String("app", "", "Only show backups that changed this app")
+	logLimit := logCmd.Int("limit", 20, "Maximum number of commits to show (0 for all)")
+	logConfig := logCmd.String("config", "~/.config/gitbak/gitbak.json", "Path to config file")
+	var logOverrides overrideFlags
+	logCmd.Var(&logOverrides, "path-override", "Path override in regex=replacement format (can be specified multiple times)")
+	logProfile := logCmd.String("profile", "", "Use the path overrides and vars of this profile (default: the profile matching this host)")
+
+	verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+	verifyApp := verifyCmd.String("app", "", "Only verify this specific app")
+	verifyConfig := verifyCmd.String("config", "~/.config/gitbak/gitbak.json", "Path to config file")
+	var verifyOverrides overrideFlags
+	verifyCmd.Var(&verifyOverrides, "path-override", "Path override in regex=replacement format (can be specified multiple times)")
+	verifyProfile := verifyCmd.String("profile", "", "Use the path overrides and vars of this profile (default: the profile matching this host)")
 
 	if len(os.Args) < 2 {
 		help.PrintGeneralHelp()
@@ -83,18 +135,47 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Error loading config from %s: %v\n", configPath, err)
 			os.Exit(1)
 		}
-		overrides, err := parseOverrides(backupOverrides)
+		overrides, err := pathOverrides(cfg, *backupProfile, backupOverrides)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error parsing path overrides: %v\n", err)
 			os.Exit(1)
 		}
+		if cfg.Profile != "" {
+			fmt.Printf("Using profile %s\n", cfg.Profile)
+		}
 		cfg.BackupDir = utils.ExpandPath(cfg.BackupDir, overrides)
-		if err := backup.PerformBackup(cfg, *backupDryRun, overrides); err != nil {
-			fmt.Fprintf(os.Stderr, "Backup failed: %v\n", err)
+		if err := cfg.ApplyHostLayout(cfg.Host()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
+		if cfg.HostLayout == config.HostLayoutBranch {
+			if err := git.CheckoutHostBranch(cfg.BackupDir, cfg.Host(), *backupDryRun); err != nil {
+				fmt.Fprintf(os.Stderr, "Git step failed: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		ctx, stop := interruptContext()
+		defer stop()
+		result, err := backup.PerformBackup(ctx, cfg, backup.Options{DryRun: *backupDryRun, Checksum: *backupChecksum, Jobs: *backupJobs}, overrides)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Backup failed: %v\n", err)
+			os.Exit(exitCode(err))
+		}
 		if !*backupNoCommit {
-			if err := git.CommitAndPush(cfg.BackupDir, *backupDryRun); err != nil {
+			findings, err := secrets.Check(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Secret scan failed: %v\n", err)
+				os.Exit(1)
+			}
+			if len(findings) > 0 {
+				fmt.Printf("Possible secrets in %s:\n", cfg.BackupDir)
+				secrets.Print(findings)
+				if !*backupAllowSecrets {
+					fmt.Fprintln(os.Stderr, "Refusing to commit possible secrets. Encrypt or ignore these files, or pass --allow-secrets to commit anyway.")
+					os.Exit(1)
+				}
+			}
+			if err := git.CommitAndPush(cfg, result, *backupDryRun); err != nil {
 				fmt.Fprintf(os.Stderr, "Git step failed: %v\n", err)
 				os.Exit(1)
 			}
@@ -102,22 +183,169 @@ func main() {
 
 	case "restore":
 		restoreCmd.Parse(os.Args[2:])
+		if *restoreRollback != "" {
+			if err := restore.Rollback(restore.DefaultJournalDir, *restoreRollback); err != nil {
+				fmt.Fprintf(os.Stderr, "Rollback failed: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
 		configPath := utils.ExpandPath(*restoreConfig, nil)
 		cfg, err := config.LoadConfig(configPath)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error loading config from %s: %v\n", configPath, err)
 			os.Exit(1)
 		}
-		overrides, err := parseOverrides(restoreOverrides)
+		overrides, err := pathOverrides(cfg, *restoreProfile, restoreOverrides)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error parsing path overrides: %v\n", err)
 			os.Exit(1)
 		}
+		if cfg.Profile != "" {
+			fmt.Printf("Using profile %s\n", cfg.Profile)
+		}
 		cfg.BackupDir = utils.ExpandPath(cfg.BackupDir, overrides)
-		if err := restore.Restore(cfg, *restoreDryRun, *restoreApp, overrides); err != nil {
+		host := cfg.Host()
+		if *restoreFromHost != "" {
+			host = *restoreFromHost
+		}
+		if err := cfg.ApplyHostLayout(host); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		policyName := cfg.OnConflict
+		if *restoreOnConflict != "" {
+			policyName = *restoreOnConflict
+		}
+		if *restoreInteractive {
+			policyName = string(restore.PolicyAsk)
+		}
+		policy, err := restore.ParseConflictPolicy(policyName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		opts := restore.Options{
+			DryRun:     *restoreDryRun,
+			AppName:    *restoreApp,
+			OnConflict: policy,
+			Rev:        *restoreRev,
+			At:         *restoreAt,
+			FromHost:   *restoreFromHost,
+		}
+		ctx, stop := interruptContext()
+		defer stop()
+		if err := restore.Restore(ctx, cfg, opts, overrides); err != nil {
 			fmt.Fprintf(os.Stderr, "Restore failed: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+
+	case "status":
+		// Exit codes: 0 = in sync, 1 = drift, 2 = error
+		statusCmd.Parse(os.Args[2:])
+		configPath := utils.ExpandPath(*statusConfig, nil)
+		cfg, err := config.LoadConfig(configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config from %s: %v\n", configPath, err)
+			os.Exit(2)
+		}
+		overrides, err := pathOverrides(cfg, *statusProfile, statusOverrides)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing path overrides: %v\n", err)
+			os.Exit(2)
+		}
+		cfg.BackupDir = utils.ExpandPath(cfg.BackupDir, overrides)
+		if err := cfg.ApplyHostLayout(cfg.Host()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		drifted, err := status.Status(cfg, *statusApp, *statusVerbose, overrides)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Status failed: %v\n", err)
+			os.Exit(2)
+		}
+		if drifted {
 			os.Exit(1)
 		}
+
+	case "diff":
+		// Exit codes: 0 = no differences, 1 = differences, 2 = error
+		diffCmd.Parse(os.Args[2:])
+		configPath := utils.ExpandPath(*diffConfig, nil)
+		cfg, err := config.LoadConfig(configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config from %s: %v\n", configPath, err)
+			os.Exit(2)
+		}
+		overrides, err := pathOverrides(cfg, *diffProfile, diffOverrides)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing path overrides: %v\n", err)
+			os.Exit(2)
+		}
+		cfg.BackupDir = utils.ExpandPath(cfg.BackupDir, overrides)
+		if err := cfg.ApplyHostLayout(cfg.Host()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		differs, err := diff.Diff(cfg, *diffApp, diffCmd.Arg(0), overrides)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Diff failed: %v\n", err)
+			os.Exit(2)
+		}
+		if differs {
+			os.Exit(1)
+		}
+
+	case "log":
+		logCmd.Parse(os.Args[2:])
+		configPath := utils.ExpandPath(*logConfig, nil)
+		cfg, err := config.LoadConfig(configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config from %s: %v\n", configPath, err)
+			os.Exit(1)
+		}
+		overrides, err := pathOverrides(cfg, *logProfile, logOverrides)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing path overrides: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.BackupDir = utils.ExpandPath(cfg.BackupDir, overrides)
+		if err := cfg.ApplyHostLayout(cfg.Host()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := history.Log(cfg, *logApp, logCmd.Arg(0), *logLimit, overrides); err != nil {
+			fmt.Fprintf(os.Stderr, "Log failed: %v\n", err)
+			os.Exit(1)
+		}
+	case "verify":
+		// Exit codes: 0 = intact, 1 = problems found, 2 = error
+		verifyCmd.Parse(os.Args[2:])
+		configPath := utils.ExpandPath(*verifyConfig, nil)
+		cfg, err := config.LoadConfig(configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config from %s: %v\n", configPath, err)
+			os.Exit(2)
+		}
+		overrides, err := pathOverrides(cfg, *verifyProfile, verifyOverrides)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing path overrides: %v\n", err)
+			os.Exit(2)
+		}
+		cfg.BackupDir = utils.ExpandPath(cfg.BackupDir, overrides)
+		if err := cfg.ApplyHostLayout(cfg.Host()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		failed, err := verify.Verify(cfg, *verifyApp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Verify failed: %v\n", err)
+			os.Exit(2)
+		}
+		if failed {
+			os.Exit(1)
+		}
+
 	case "--version", "-version":
 		fmt.Printf("%s\n", version)
 		os.Exit(0)
@@ -152,3 +380,38 @@ func parseOverrides(flags overrideFlags) ([]utils.PathOverride, error) {
 	}
 	return overrides, nil
 }
+
+// pathOverrides returns the overrides of the selected profile followed by
+// those given on the command line, so the command line takes precedence
+func pathOverrides(cfg *config.Config, profile string, flags overrideFlags) ([]utils.PathOverride, error) {
+	overrides, err := parseOverrides(flags)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.UseProfile(profile); err != nil {
+		return nil, err
+	}
+	return cfg.PathOverrides(overrides)
+}
+
+// interruptContext returns a context that is cancelled on the first Ctrl-C or
+// SIGTERM, letting backup and restore stop cleanly. A second Ctrl-C kills
+// gitbak right away.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		fmt.Fprintln(os.Stderr, "\nInterrupted, finishing the current files (press Ctrl-C again to quit immediately)")
+	}()
+	return ctx, stop
+}
+
+// exitCode returns the exit status for a failed backup or restore, using the
+// shell convention for Ctrl-C if it was interrupted
+func exitCode(err error) int {
+	if errors.Is(err, context.Canceled) {
+		return 130
+	}
+	return 1
+}
@@ -0,0 +1,188 @@
+package restore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kennyparsons/gitbak/diff"
+	"github.com/kennyparsons/gitbak/internal/crypt"
+	"github.com/kennyparsons/gitbak/internal/redact"
+)
+
+// ConflictPolicy decides what happens when a restore target already exists
+type ConflictPolicy string
+
+const (
+	// PolicyAsk prompts on every conflict
+	PolicyAsk ConflictPolicy = "ask"
+	// PolicySkip leaves existing files untouched
+	PolicySkip ConflictPolicy = "skip"
+	// PolicyOverwrite replaces existing files
+	PolicyOverwrite ConflictPolicy = "overwrite"
+	// PolicyBackup moves existing files aside before restoring
+	PolicyBackup ConflictPolicy = "backup"
+	// PolicyNewer only replaces files whose backup copy is newer
+	PolicyNewer ConflictPolicy = "newer"
+	// PolicyFail aborts the restore on the first conflict
+	PolicyFail ConflictPolicy = "fail"
+)
+
+// ErrConflict is returned by Restore when a conflict is hit under PolicyFail
+var ErrConflict = errors.New("restore target already exists")
+
+// ParseConflictPolicy validates a conflict policy name. An empty name selects
+// PolicyAsk.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return PolicyAsk, nil
+	case PolicyAsk, PolicySkip, PolicyOverwrite, PolicyBackup, PolicyNewer, PolicyFail:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid conflict policy %q, must be one of ask, skip, overwrite, backup, newer, fail", s)
+	}
+}
+
+type conflictAction int
+
+const (
+	actionSkip conflictAction = iota
+	actionOverwrite
+	actionBackup
+)
+
+// resolveConflict decides what to do with an existing destination according
+// to the restore's conflict policy, prompting if the policy is PolicyAsk
+func (r *restorer) resolveConflict(ctx context.Context, backupPath, livePath, relPath string) (conflictAction, error) {
+	switch r.policy {
+	case PolicySkip:
+		fmt.Printf("  [conflict] %s already exists\n", livePath)
+		return actionSkip, nil
+	case PolicyOverwrite:
+		return actionOverwrite, nil
+	case PolicyBackup:
+		return actionBackup, nil
+	case PolicyFail:
+		return actionSkip, fmt.Errorf("%w: %s", ErrConflict, livePath)
+	case PolicyNewer:
+		info, err := os.Lstat(backupPath)
+		if err != nil {
+			return actionSkip, err
+		}
+		if info.IsDir() {
+			// Directories are compared file by file while restoring
+			return actionOverwrite, nil
+		}
+		newer, err := backupIsNewer(r.backupModTime(relPath, info), livePath)
+		if err != nil {
+			return actionSkip, err
+		}
+		if !newer {
+			fmt.Printf("  [conflict] %s is newer than the backup\n", livePath)
+			return actionSkip, nil
+		}
+		return actionOverwrite, nil
+	}
+
+	if r.stdin == nil {
+		r.stdin = bufio.NewReader(os.Stdin)
+	}
+	for {
+		fmt.Printf("  [conflict] %s already exists. (s)kip, (o)verwrite, (b)ackup, show (d)iff, (O)verwrite all, (S)kip all? ", livePath)
+		response, err := r.readResponse(ctx)
+		if err != nil {
+			return actionSkip, err
+		}
+
+		switch strings.TrimSpace(response) {
+		case "o":
+			return actionOverwrite, nil
+		case "b":
+			return actionBackup, nil
+		case "d":
+			if err := printConflictDiff(backupPath, livePath, r.keys, r.rules); err != nil {
+				fmt.Printf("  [warning] could not diff %s: %v\n", livePath, err)
+			}
+			continue
+		case "O":
+			r.policy = PolicyOverwrite
+			return actionOverwrite, nil
+		case "S":
+			r.policy = PolicySkip
+			return actionSkip, nil
+		default:
+			return actionSkip, nil
+		}
+	}
+}
+
+// readResponse reads a line of input for a prompt, giving up if ctx is
+// cancelled while waiting
+func (r *restorer) readResponse(ctx context.Context) (string, error) {
+	line := make(chan string, 1)
+	go func() {
+		response, _ := r.stdin.ReadString('\n')
+		line <- response
+	}()
+	select {
+	case response := <-line:
+		return response, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// backupIsNewer reports whether backupTime is after the modification time of
+// the live file. A missing live file counts as older.
+func backupIsNewer(backupTime time.Time, livePath string) (bool, error) {
+	info, err := os.Stat(livePath)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return backupTime.After(info.ModTime()), nil
+}
+
+// printConflictDiff shows what restoring backupPath over livePath would change,
+// keeping the secrets rules pick out of the live files hidden
+func printConflictDiff(backupPath, livePath string, keys *crypt.KeyLoader, rules []redact.Rule) error {
+	info, err := os.Stat(backupPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		out, err := diff.Files(backupPath, livePath, keys, rules)
+		if err != nil {
+			return err
+		}
+		fmt.Print(out)
+		return nil
+	}
+
+	return filepath.Walk(backupPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(backupPath, path)
+		if err != nil {
+			return err
+		}
+		live := filepath.Join(livePath, rel)
+		if _, err := os.Stat(live); os.IsNotExist(err) {
+			live = ""
+		}
+		out, err := diff.Files(path, live, keys, rules)
+		if err != nil {
+			return err
+		}
+		fmt.Print(out)
+		return nil
+	})
+}
@@ -0,0 +1,368 @@
+package restore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kennyparsons/gitbak/backup"
+	"github.com/kennyparsons/gitbak/internal/utils"
+)
+
+// Every restore keeps a journal of the paths it changes, so it can be undone.
+// Before a path is touched, whatever is there is recorded: regular files are
+// copied into the journal, directories and symlinks only need their metadata,
+// and paths that don't exist yet are marked as created. Each journal is a
+// directory under the journal root:
+//
+//	<root>/<id>/journal.jsonl  one entry per line, in the order they were made
+//	<root>/<id>/<n>            previous contents of a regular file
+//
+// Entries are written before the change they describe, so even the journal of
+// a restore that crashed covers everything it touched.
+
+// DefaultJournalDir is where restore journals are kept by default
+const DefaultJournalDir = "~/.local/state/gitbak/restores"
+
+// keepJournals is how many restore journals are kept around for --rollback
+const keepJournals = 10
+
+const journalFileName = "journal.jsonl"
+
+// journalEntry records the state of a path before a restore changed it
+type journalEntry struct {
+	Path string `json:"path"`
+	// Created is set when nothing existed at Path before the restore
+	Created bool `json:"created,omitempty"`
+	// MovedTo is where the backup conflict policy moved the original
+	MovedTo string `json:"moved_to,omitempty"`
+	// Snapshot names the copy of a regular file's previous contents
+	Snapshot string `json:"snapshot,omitempty"`
+	// Metadata of what existed at Path, with Link set for symlinks
+	Metadata *backup.FileMetadata `json:"metadata,omitempty"`
+}
+
+// journal records the changes of a single restore run. The journal directory
+// is only created once the first change is recorded. A nil journal records
+// nothing, which is what dry runs use.
+type journal struct {
+	root string
+	id   string // Empty until the first change is recorded
+	dir  string
+	file *os.File
+	// Paths already recorded; only the first snapshot of a path counts, as
+	// later ones would see what the restore wrote
+	seen      map[string]bool
+	snapshots int
+}
+
+// newJournal returns a journal that will be kept under root
+func newJournal(root string) *journal {
+	return &journal{root: utils.ExpandPath(root, nil), seen: make(map[string]bool)}
+}
+
+// record snapshots whatever is at path before the restore changes it
+func (j *journal) record(path string) error {
+	if j == nil || j.seen[path] {
+		return nil
+	}
+
+	e := journalEntry{Path: path}
+	info, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		e.Created = true
+	case err != nil:
+		return fmt.Errorf("failed to snapshot %s: %v", path, err)
+	default:
+		meta, err := backup.CollectFileMetadata(path, info)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot %s: %v", path, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if meta.Link, err = os.Readlink(path); err != nil {
+				return fmt.Errorf("failed to snapshot %s: %v", path, err)
+			}
+		}
+		e.Metadata = &meta
+	}
+
+	if err := j.open(); err != nil {
+		return err
+	}
+	if e.Metadata != nil && e.Metadata.Mode.IsRegular() {
+		if e.Snapshot, err = j.snapshot(path); err != nil {
+			return fmt.Errorf("failed to snapshot %s: %v", path, err)
+		}
+	}
+	if err := j.append(e); err != nil {
+		return err
+	}
+	j.seen[path] = true
+	return nil
+}
+
+// recordDirs records every directory leading up to and including dir that
+// doesn't exist yet, top down, before they are created
+func (j *journal) recordDirs(dir string) error {
+	if j == nil {
+		return nil
+	}
+	var missing []string
+	for d := dir; filepath.Dir(d) != d; d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); !os.IsNotExist(err) {
+			break
+		}
+		missing = append(missing, d)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := j.record(missing[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordMove records that the original at path was moved to movedTo
+func (j *journal) recordMove(path, movedTo string) error {
+	if j == nil {
+		return nil
+	}
+	if err := j.open(); err != nil {
+		return err
+	}
+	if err := j.append(journalEntry{Path: path, MovedTo: movedTo}); err != nil {
+		return err
+	}
+	// Whatever is restored at path next replaces nothing
+	delete(j.seen, path)
+	return nil
+}
+
+// open creates the journal directory on first use, pruning old journals
+func (j *journal) open() error {
+	if j.file != nil {
+		return nil
+	}
+	if err := os.MkdirAll(j.root, 0700); err != nil {
+		return fmt.Errorf("failed to create journal directory: %v", err)
+	}
+	pruneJournals(j.root, keepJournals-1)
+
+	base := time.Now().Format("20060102-150405")
+	id := base
+	for i := 2; ; i++ {
+		err := os.Mkdir(filepath.Join(j.root, id), 0700)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("failed to create journal directory: %v", err)
+		}
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	dir := filepath.Join(j.root, id)
+	f, err := os.OpenFile(filepath.Join(dir, journalFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create journal: %v", err)
+	}
+	j.id, j.dir, j.file = id, dir, f
+	return nil
+}
+
+// snapshot copies the regular file at path into the journal and returns the
+// name of the copy
+func (j *journal) snapshot(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	j.snapshots++
+	name := strconv.Itoa(j.snapshots)
+	if err := utils.WriteFileAtomic(filepath.Join(j.dir, name), src, 0600); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// append writes e to the journal file and syncs it, so the entry is on disk
+// before the change it describes is made
+func (j *journal) append(e journalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal entry: %v", err)
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	return nil
+}
+
+// close closes the journal file, if any
+func (j *journal) close() {
+	if j != nil && j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+}
+
+// Rollback undoes the restore recorded in the journal id under journalDir,
+// putting every path it touched back the way it was. The journal is removed
+// once everything has been rolled back.
+func Rollback(journalDir, id string) error {
+	root := utils.ExpandPath(journalDir, nil)
+	if id == "" || strings.ContainsRune(id, filepath.Separator) {
+		return fmt.Errorf("invalid restore journal id %q", id)
+	}
+	dir := filepath.Join(root, id)
+	if _, err := os.Stat(filepath.Join(dir, journalFileName)); err != nil {
+		ids := listJournals(root)
+		if len(ids) == 0 {
+			return fmt.Errorf("restore journal %s not found, no journals in %s", id, root)
+		}
+		return fmt.Errorf("restore journal %s not found (available: %s)", id, strings.Join(ids, ", "))
+	}
+
+	fmt.Printf("● Rolling back restore %s\n", id)
+	return rollbackJournal(dir)
+}
+
+// rollbackJournal undoes the entries of the journal in dir, newest first. It
+// carries on past paths that can't be put back and keeps the journal if there
+// were any, so the rollback can be retried.
+func rollbackJournal(dir string) error {
+	entries, err := readJournal(dir)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if err := undoEntry(dir, e); err != nil {
+			fmt.Printf("  [error] rolling back %s: %v\n", e.Path, err)
+			failed++
+			continue
+		}
+		fmt.Printf("  [rolled back] %s\n", e.Path)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d path(s) could not be rolled back, journal kept in %s", failed, dir)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove journal: %v", err)
+	}
+	return nil
+}
+
+// readJournal reads the entries of the journal in dir. A truncated last line,
+// left by a crash while it was written, is ignored.
+func readJournal(dir string) ([]journalEntry, error) {
+	f, err := os.Open(filepath.Join(dir, journalFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %v", err)
+	}
+	defer f.Close()
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read journal: %v", err)
+	}
+	return entries, nil
+}
+
+// undoEntry puts a single path back the way the journal recorded it
+func undoEntry(dir string, e journalEntry) error {
+	switch {
+	case e.MovedTo != "":
+		// The entry is written before the move, which may never have
+		// happened
+		if _, err := os.Lstat(e.MovedTo); os.IsNotExist(err) {
+			return nil
+		}
+		// Whatever was restored in its place has been removed by now
+		if _, err := os.Lstat(e.Path); err == nil {
+			return fmt.Errorf("cannot move %s back, the path is in use", e.MovedTo)
+		}
+		return os.Rename(e.MovedTo, e.Path)
+
+	case e.Created:
+		// Directories are only removed once empty, so files added to them
+		// since the restore are left alone
+		if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+
+	case e.Metadata == nil:
+		return fmt.Errorf("journal entry has no metadata")
+
+	case e.Metadata.Mode.IsDir():
+		if err := os.MkdirAll(e.Path, e.Metadata.Mode.Perm()); err != nil {
+			return err
+		}
+
+	case e.Metadata.Mode&os.ModeSymlink != 0:
+		if err := replaceWithSymlink(e.Metadata.Link, e.Path); err != nil {
+			return err
+		}
+
+	default:
+		src, err := os.Open(filepath.Join(dir, e.Snapshot))
+		if err != nil {
+			return fmt.Errorf("failed to open snapshot: %v", err)
+		}
+		defer src.Close()
+		if err := utils.WriteFileAtomic(e.Path, src, e.Metadata.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	return applyMetadata(e.Path, *e.Metadata, false)
+}
+
+// listJournals returns the ids of the journals under root, oldest first
+func listJournals(root string) []string {
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		return nil
+	}
+	var ids []string
+	for _, d := range dirs {
+		if _, err := os.Stat(filepath.Join(root, d.Name(), journalFileName)); err == nil {
+			ids = append(ids, d.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// pruneJournals removes the oldest journals under root so at most keep are
+// left
+func pruneJournals(root string, keep int) {
+	ids := listJournals(root)
+	for len(ids) > keep {
+		os.RemoveAll(filepath.Join(root, ids[0]))
+		ids = ids[1:]
+	}
+}
@@ -2,6 +2,9 @@ package restore
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -11,14 +14,84 @@ import (
 
 	"github.com/kennyparsons/gitbak/backup"
 	"github.com/kennyparsons/gitbak/config"
+	"github.com/kennyparsons/gitbak/git"
+	"github.com/kennyparsons/gitbak/internal/crypt"
+	"github.com/kennyparsons/gitbak/internal/redact"
 	"github.com/kennyparsons/gitbak/internal/utils"
 )
 
-// Restore restores files from the backup directory to their original locations.
-// If appName is not empty, only restores the specified app.
-func Restore(cfg *config.Config, dryRun bool, appName string, overrides []utils.PathOverride) error {
+// Options controls how Restore behaves
+type Options struct {
+	DryRun bool
+	// AppName restricts the restore to a single app when not empty
+	AppName string
+	// OnConflict decides what happens when a destination already exists
+	OnConflict ConflictPolicy
+	// Rev restores files as of a commit, tag or branch instead of the
+	// working tree of the backup directory
+	Rev string
+	// At restores files as of the last commit at or before this date
+	At string
+	// FromHost restores another machine's backups. With the directory host
+	// layout the caller selects the host's directory; with the branch layout
+	// Restore reads the host's branch from the remote.
+	FromHost string
+	// JournalDir is where the restore journal is kept, DefaultJournalDir if
+	// empty
+	JournalDir string
+}
+
+// Restore restores files from the backup directory to their original
+// locations. Every path it changes is recorded in a journal first; if a path
+// fails to restore, everything restored so far is rolled back. If ctx is
+// cancelled, the file being restored is finished and nothing else is touched,
+// and the journal is kept so the partial restore can be rolled back by hand.
+func Restore(ctx context.Context, cfg *config.Config, opts Options, overrides []utils.PathOverride) error {
+	backupRoot := cfg.BackupDir
+
+	if opts.FromHost != "" {
+		switch cfg.HostLayout {
+		case config.HostLayoutDirectory:
+			// Already applied to cfg.BackupDir
+		case config.HostLayoutBranch:
+			if opts.Rev != "" {
+				return fmt.Errorf("--rev cannot be combined with --from-host when backups are kept on per-host branches")
+			}
+			if err := git.Fetch(cfg.BackupDir); err != nil {
+				return err
+			}
+			host := utils.SanitizeName(opts.FromHost)
+			if err := utils.CheckHostName(host); err != nil {
+				return err
+			}
+			opts.Rev = "origin/" + git.HostBranch(host)
+		default:
+			return fmt.Errorf("--from-host requires host_layout to be set in the config")
+		}
+	}
+
+	// Restoring from history reads the blobs out of git into a scratch
+	// directory, leaving the backup repository itself untouched
+	if opts.Rev != "" || opts.At != "" {
+		commit, err := git.ResolveRev(cfg.BackupDir, opts.Rev, opts.At)
+		if err != nil {
+			return err
+		}
+		tmpDir, err := os.MkdirTemp("", "gitbak-restore-")
+		if err != nil {
+			return fmt.Errorf("failed to create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		if err := git.ExportTree(cfg.BackupDir, commit.Hash, tmpDir); err != nil {
+			return err
+		}
+		fmt.Printf("● Using backup from commit %s (%s)\n", commit.Hash[:12], commit.Date.Format("2006-01-02 15:04:05"))
+		backupRoot = tmpDir
+	}
+
 	// Load metadata
-	metadata, err := loadMetadata(cfg.BackupDir)
+	metadata, err := loadMetadata(backupRoot)
 	if err != nil {
 		fmt.Printf("  [warning] Failed to load metadata: %v\n", err)
 	}
@@ -29,114 +102,241 @@ func Restore(cfg *config.Config, dryRun bool, appName string, overrides []utils.
 		metadataMap[meta.Path] = meta
 	}
 
+	r := &restorer{
+		policy:       opts.OnConflict,
+		dryRun:       opts.DryRun,
+		metadata:     metadataMap,
+		keys:         &crypt.KeyLoader{Dir: backupRoot, KeyFile: cfg.EncryptionKeyFile},
+		secretsFile:  redact.StorePath(cfg),
+		templateData: newTemplateData(cfg),
+	}
+	if !opts.DryRun {
+		journalDir := opts.JournalDir
+		if journalDir == "" {
+			journalDir = DefaultJournalDir
+		}
+		r.journal = newJournal(journalDir)
+		defer r.journal.close()
+	}
+
 	// Process custom apps
 	for currentAppName, appCfg := range cfg.CustomApps {
-		if appName != "" && currentAppName != appName {
+		if opts.AppName != "" && currentAppName != opts.AppName {
 			continue
 		}
 
 		fmt.Printf("● Restoring app: %s\n", currentAppName)
-		backupAppDir := filepath.Join(cfg.BackupDir, currentAppName)
+		backupAppDir := filepath.Join(backupRoot, currentAppName)
+		if r.rules, err = redact.Compile(appCfg.Redact); err != nil {
+			return r.rollBack(fmt.Errorf("%s: %v", currentAppName, err))
+		}
 
 		for _, srcPath := range appCfg.Paths {
 			expandedSrc := utils.ExpandPath(srcPath, overrides)
 			srcBase := filepath.Base(expandedSrc)
 			backupPath := filepath.Join(backupAppDir, srcBase)
-
-			if _, err := os.Stat(backupPath); os.IsNotExist(err) {
-				backupPath = filepath.Join(backupAppDir, filepath.Base(expandedSrc))
-			}
+			relPath := filepath.Join(currentAppName, srcBase)
 
 			// Handle the restore
-			if err := restorePath(backupPath, expandedSrc, dryRun); err != nil {
-				fmt.Printf("  [error] restoring %s: %v\n", srcPath, err)
+			err := r.restorePath(ctx, backupPath, expandedSrc, relPath)
+			if ctx.Err() != nil {
+				if r.journal != nil && r.journal.id != "" {
+					fmt.Printf("  Undo the files restored so far with: gitbak restore --rollback %s\n", r.journal.id)
+				}
+				return fmt.Errorf("restore interrupted: %w", ctx.Err())
 			}
-
-			// Apply metadata if available
-			relPath := filepath.Join(currentAppName, filepath.Base(expandedSrc))
-			if meta, exists := metadataMap[relPath]; exists {
-				if err := applyMetadata(expandedSrc, meta, dryRun); err != nil {
-					fmt.Printf("  [warning] Failed to apply metadata to %s: %v\n",
-						expandedSrc, err)
+			if err != nil {
+				if !errors.Is(err, ErrConflict) {
+					fmt.Printf("  [error] restoring %s: %v\n", srcPath, err)
+					err = fmt.Errorf("restoring %s: %v", srcPath, err)
 				}
+				return r.rollBack(err)
 			}
 		}
 	}
 
+	if r.foreignOwned > 0 {
+		fmt.Printf("  [warning] Need root to set the recorded ownership of %d path(s), e.g. %s; they are owned by the current user\n",
+			r.foreignOwned, r.firstForeign)
+	}
+	if r.journal != nil && r.journal.id != "" {
+		fmt.Printf("● Restore journal: %s (undo with: gitbak restore --rollback %s)\n", r.journal.id, r.journal.id)
+	}
 	return nil
 }
 
+// rollBack undoes everything restored so far after cause made the restore
+// fail, and returns cause along with the outcome of the rollback
+func (r *restorer) rollBack(cause error) error {
+	if r.journal == nil || r.journal.id == "" {
+		return cause
+	}
+	r.journal.close()
+	fmt.Printf("● Rolling back restore %s\n", r.journal.id)
+	if err := rollbackJournal(r.journal.dir); err != nil {
+		return fmt.Errorf("%w; rollback failed: %v", cause, err)
+	}
+	return fmt.Errorf("%w; all changes were rolled back", cause)
+}
 
+// restorer carries the state of a single restore run
+type restorer struct {
+	policy   ConflictPolicy
+	dryRun   bool
+	metadata map[string]backup.FileMetadata
+	stdin    *bufio.Reader
+	// Decrypts the files of encrypted apps
+	keys *crypt.KeyLoader
+	// Values for the placeholders in redacted files, loaded from secretsFile
+	// when the first one is restored
+	secretsFile string
+	secrets     map[string]string
+	// Renders the templates in the backup
+	templateData TemplateData
+	// The redact rules of the app being restored, to keep secrets out of
+	// conflict diffs
+	rules []redact.Rule
+	// Records every path before it is changed, nil in dry runs
+	journal *journal
+	// How many restored paths are recorded with an owner that takes root
+	// to set, and the first of them
+	foreignOwned int
+	firstForeign string
+}
 
-func restorePath(backupPath, originalPath string, dryRun bool) error {
+// restorePath restores a single app path along with its recorded metadata.
+// relPath is the path of backupPath relative to the backup root, which is
+// what metadata is keyed by.
+func (r *restorer) restorePath(ctx context.Context, backupPath, originalPath, relPath string) error {
 	// Expand ~ in the original path
 	expandedOriginal := utils.ExpandPath(originalPath, nil)
 
 	// Check if the backup path exists
-	backupInfo, err := os.Stat(backupPath)
+	backupInfo, err := os.Lstat(backupPath)
 	if os.IsNotExist(err) {
-		// If not found, try to find the backup in the new structure
-		// For directories, the backup might be in backupAppDir/dirname
-		backupDir := filepath.Dir(backupPath)
-		srcBase := filepath.Base(expandedOriginal)
-		backupPath = filepath.Join(backupDir, srcBase)
-
-		backupInfo, err = os.Stat(backupPath)
-		if os.IsNotExist(err) {
-			return fmt.Errorf("backup not found: %s (tried %s)", filepath.Base(expandedOriginal), backupPath)
+		// The file may be rendered from a template instead
+		tmplInfo, tmplErr := os.Lstat(backupPath + backup.TemplateSuffix)
+		if tmplErr == nil && tmplInfo.Mode().IsRegular() && r.isTemplate(relPath+backup.TemplateSuffix) {
+			backupPath += backup.TemplateSuffix
+			relPath += backup.TemplateSuffix
+			backupInfo, err = tmplInfo, nil
 		}
+	}
+	if os.IsNotExist(err) {
+		// Paths missing on the machine that was backed up have no backup;
+		// that's not a failure worth rolling back for
+		fmt.Printf("  [skipped] %s (no backup found at %s)\n", expandedOriginal, backupPath)
+		return nil
 	} else if err != nil {
 		return fmt.Errorf("error checking backup path: %v", err)
 	}
 
 	// In dry-run mode, just show what would happen
-	if dryRun {
+	if r.dryRun {
 		if backupInfo.IsDir() {
 			fmt.Printf("[dry-run] Would restore directory %s → %s\n", backupPath, expandedOriginal)
-			return nil
+		} else if backupInfo.Mode()&os.ModeSymlink != 0 {
+			fmt.Printf("[dry-run] Would restore symlink %s → %s\n", backupPath, expandedOriginal)
+		} else {
+			fmt.Printf("[dry-run] Would restore file %s → %s\n", backupPath, expandedOriginal)
 		}
-		fmt.Printf("[dry-run] Would restore file %s → %s\n", backupPath, expandedOriginal)
+		r.applyMetadata(expandedOriginal, relPath)
 		return nil
 	}
 
 	// Check if destination exists
 	if _, err := os.Stat(expandedOriginal); err == nil {
-		// Destination exists, prompt for action
-		fmt.Printf("  [conflict] %s already exists. (s)kip, (o)verwrite, (b)ackup? ", expandedOriginal)
-		reader := bufio.NewReader(os.Stdin)
-		response, _ := reader.ReadString('\n')
-		response = strings.TrimSpace(strings.ToLower(response))
-
-		switch response {
-		case "o": // Overwrite
-			// Continue with restore
-		case "b": // Backup
-			backupPath := fmt.Sprintf("%s.gitbak-restore-state-%s", expandedOriginal, time.Now().Format("2006-01-02T15:04:05"))
-			if err := os.Rename(expandedOriginal, backupPath); err != nil {
-				return fmt.Errorf("failed to backup existing file: %v", err)
-			}
-			fmt.Printf("  [backup] created backup at %s\n", backupPath)
-		case "s": // Skip
-			fallthrough
-		default:
+		action, err := r.resolveConflict(ctx, backupPath, expandedOriginal, relPath)
+		if err != nil {
+			return err
+		}
+		switch action {
+		case actionSkip:
 			fmt.Println("  [skipped]")
 			return nil
+		case actionBackup:
+			if err := r.backupExisting(expandedOriginal); err != nil {
+				return err
+			}
 		}
 	}
 
-	if backupInfo.IsDir() {
-		return restoreDirectory(backupPath, expandedOriginal, dryRun)
+	switch {
+	case backupInfo.IsDir():
+		return r.restoreDirectory(ctx, backupPath, expandedOriginal, relPath)
+	case backupInfo.Mode()&os.ModeSymlink != 0:
+		if err = r.restoreSymlink(backupPath, expandedOriginal); err == nil {
+			warnIfDangling(expandedOriginal)
+		}
+	default:
+		err = r.restoreFile(backupPath, expandedOriginal, relPath)
+	}
+	if err != nil {
+		return err
 	}
-	return restoreFile(backupPath, expandedOriginal, dryRun)
+	r.applyMetadata(expandedOriginal, relPath)
+	return nil
 }
 
-func restoreFile(src, dst string, dryRun bool) error {
-	if dryRun {
+// applyMetadata applies the metadata recorded for relPath, if any, to a
+// restored file or directory
+func (r *restorer) applyMetadata(targetPath, relPath string) {
+	meta, exists := r.metadata[relPath]
+	if !exists {
+		return
+	}
+	if err := applyMetadata(targetPath, meta, r.dryRun); err != nil {
+		fmt.Printf("  [warning] Failed to apply metadata to %s: %v\n", targetPath, err)
+		return
+	}
+	if !r.dryRun && meta.Mode&os.ModeSymlink == 0 && needsRoot(meta) {
+		if r.foreignOwned == 0 {
+			r.firstForeign = fmt.Sprintf("%s (UID: %d, GID: %d)", targetPath, meta.Uid, meta.Gid)
+		}
+		r.foreignOwned++
+	}
+}
+
+// backupModTime returns when the backup copy at relPath was last modified
+// on the machine it was taken from, falling back to the copy's own mtime
+func (r *restorer) backupModTime(relPath string, info os.FileInfo) time.Time {
+	if meta, ok := r.metadata[relPath]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, meta.Modified); err == nil {
+			return t
+		}
+	}
+	return info.ModTime()
+}
+
+// backupExisting moves a live file out of the way before it is restored over
+func (r *restorer) backupExisting(path string) error {
+	backupPath := fmt.Sprintf("%s.gitbak-restore-state-%s", path, time.Now().Format("2006-01-02T15:04:05"))
+	// The move is journaled first, so a crash right after it can still be
+	// rolled back. If the rename fails, rolling back finds nothing at
+	// backupPath and leaves path alone.
+	if err := r.journal.recordMove(path, backupPath); err != nil {
+		return err
+	}
+	if err := os.Rename(path, backupPath); err != nil {
+		return fmt.Errorf("failed to backup existing file: %v", err)
+	}
+	fmt.Printf("  [backup] created backup at %s\n", backupPath)
+	return nil
+}
+
+// restoreFile restores the backup copy src to dst, decrypting it, filling in
+// redacted secrets and rendering it as a template as needed. relPath is the path of src relative to the
+// backup root.
+func (r *restorer) restoreFile(src, dst, relPath string) error {
+	if r.dryRun {
 		fmt.Printf("[dry-run] Restore file %s → %s\n", src, dst)
 		return nil
 	}
 
 	// Ensure the destination directory exists
+	if err := r.journal.recordDirs(filepath.Dir(dst)); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
 		return fmt.Errorf("failed to create destination directory: %v", err)
 	}
@@ -148,29 +348,146 @@ func restoreFile(src, dst string, dryRun bool) error {
 	}
 	defer srcFile.Close()
 
-	// Create destination file
-	dstFile, err := os.Create(dst)
+	srcInfo, err := srcFile.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to create destination file: %v", err)
+		return fmt.Errorf("failed to stat source file: %v", err)
 	}
-	defer dstFile.Close()
 
-	// Copy the file contents
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return fmt.Errorf("failed to copy file contents: %v", err)
+	// Files of encrypted apps are decrypted on the way out
+	contents := bufio.NewReader(srcFile)
+	var plaintext io.Reader = contents
+	if header, _ := contents.Peek(len(crypt.Header)); crypt.IsEncrypted(header) {
+		data, err := crypt.ReadFile(src, r.keys)
+		if err != nil {
+			return err
+		}
+		plaintext = bytes.NewReader(data)
+	}
+	if len(r.metadata[relPath].Secrets) > 0 {
+		if plaintext, err = r.fillSecrets(plaintext, dst); err != nil {
+			return err
+		}
+	}
+	if r.isTemplate(relPath) {
+		if plaintext, err = r.render(plaintext, src); err != nil {
+			return err
+		}
+	}
+
+	// Live configs are often symlinks into a dotfiles checkout; write to
+	// the file they point to rather than replacing the link
+	target := dst
+	if resolved, err := filepath.EvalSymlinks(dst); err == nil {
+		target = resolved
 	}
 
-	// Preserve file mode
-	if srcInfo, err := os.Stat(src); err == nil {
-		os.Chmod(dst, srcInfo.Mode())
+	if err := r.journal.record(target); err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it into place, so a failed
+	// restore never leaves a truncated file behind. git only keeps the
+	// executable bit of the copy, so the recorded mode is used from the
+	// start; a private key is never readable by others at its final path.
+	perm := srcInfo.Mode().Perm()
+	if meta, ok := r.metadata[relPath]; ok && meta.Mode.IsRegular() {
+		perm = meta.Mode.Perm()
+	}
+	if err := utils.WriteFileAtomic(target, plaintext, perm); err != nil {
+		return err
 	}
 
 	fmt.Printf("  [restored] %s\n", dst)
 	return nil
 }
 
-func restoreDirectory(src, dst string, dryRun bool) error {
-	if dryRun {
+// fillSecrets puts the secret values back into the contents of a redacted
+// file. Placeholders without a value are left in place with a warning.
+func (r *restorer) fillSecrets(contents io.Reader, dst string) (io.Reader, error) {
+	if r.secrets == nil {
+		store, err := redact.LoadStore(r.secretsFile)
+		if err != nil {
+			return nil, err
+		}
+		r.secrets = store
+	}
+	data, err := io.ReadAll(contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source file: %v", err)
+	}
+	data, missing := redact.Fill(data, r.secrets)
+	for _, name := range missing {
+		fmt.Printf("  [warning] no value for secret %s in %s; set %s or add it to %s\n", name, dst, redact.EnvVar(name), r.secretsFile)
+	}
+	return bytes.NewReader(data), nil
+}
+
+// restoreSymlink recreates the symlink stored at src in the backup tree at
+// dst
+func (r *restorer) restoreSymlink(src, dst string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return fmt.Errorf("failed to read symlink %s: %v", src, err)
+	}
+	if existing, err := os.Readlink(dst); err == nil && existing == target {
+		return nil
+	}
+	if r.dryRun {
+		fmt.Printf("[dry-run] Restore symlink %s → %s\n", dst, target)
+		return nil
+	}
+
+	if info, err := os.Lstat(dst); err == nil && info.IsDir() {
+		return fmt.Errorf("%s is a directory, not replacing it with a symlink", dst)
+	}
+	if err := r.journal.recordDirs(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %v", err)
+	}
+	if err := r.journal.record(dst); err != nil {
+		return err
+	}
+	if err := replaceWithSymlink(target, dst); err != nil {
+		return err
+	}
+
+	fmt.Printf("  [restored] %s → %s\n", dst, target)
+	return nil
+}
+
+// replaceWithSymlink makes dst a symlink to target. The link is swapped in
+// with a rename, like files are.
+func replaceWithSymlink(target, dst string) error {
+	tmp := dst + ".gitbak-tmp-link"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("failed to create symlink: %v", err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace %s: %v", dst, err)
+	}
+	return nil
+}
+
+// warnIfDangling reports a restored symlink whose target doesn't exist on
+// this machine
+func warnIfDangling(path string) {
+	if _, err := os.Stat(path); err != nil {
+		if target, err := os.Readlink(path); err == nil {
+			fmt.Printf("  [warning] %s is a dangling symlink to %s\n", path, target)
+		}
+	}
+}
+
+// restoreDirectory restores the directory tree at src to dst, applying the
+// metadata recorded for each file and directory in it. relRoot is the path
+// of src relative to the backup root. It stops between files if ctx is
+// cancelled.
+func (r *restorer) restoreDirectory(ctx context.Context, src, dst, relRoot string) error {
+	if r.dryRun {
 		fmt.Printf("[dry-run] Restore directory %s → %s\n", src, dst)
 		return nil
 	}
@@ -183,14 +500,27 @@ func restoreDirectory(src, dst string, dryRun bool) error {
 	}
 
 	// Create the destination directory with the same permissions as source
+	if err := r.journal.recordDirs(filepath.Dir(dst)); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
 		return fmt.Errorf("failed to create parent directory: %v", err)
 	}
 
-	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+	// Directory metadata is applied once everything inside has been written,
+	// deepest first, so restrictive modes and mtimes stick
+	var dirs []string
+	// Links can point at files restored later on, so they are checked at
+	// the end
+	var links []string
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		// Calculate the relative path from the source directory
 		relPath, err := filepath.Rel(src, path)
@@ -201,6 +531,9 @@ func restoreDirectory(src, dst string, dryRun bool) error {
 		dstPath := filepath.Join(dst, relPath)
 
 		if info.IsDir() {
+			if err := r.journal.record(dstPath); err != nil {
+				return err
+			}
 			// Create the directory with the same permissions as source
 			if err := os.MkdirAll(dstPath, info.Mode()); err != nil {
 				return fmt.Errorf("failed to create directory %s: %v", dstPath, err)
@@ -209,10 +542,44 @@ func restoreDirectory(src, dst string, dryRun bool) error {
 			if err := os.Chmod(dstPath, info.Mode()); err != nil {
 				return fmt.Errorf("failed to set permissions for %s: %v", dstPath, err)
 			}
+			dirs = append(dirs, relPath)
+			return nil
+		}
+
+		metaPath := filepath.Join(relRoot, relPath)
+		if info.Mode()&os.ModeSymlink != 0 {
+			if err := r.restoreSymlink(path, dstPath); err != nil {
+				return err
+			}
+			links = append(links, dstPath)
+			r.applyMetadata(dstPath, metaPath)
 			return nil
 		}
+		if r.isTemplate(metaPath) {
+			dstPath = strings.TrimSuffix(dstPath, backup.TemplateSuffix)
+		}
+
+		// With the "newer" policy, decide file by file inside directories
+		if r.policy == PolicyNewer {
+			if newer, err := backupIsNewer(r.backupModTime(metaPath, info), dstPath); err == nil && !newer {
+				fmt.Printf("  [skipped] %s (live file is newer)\n", dstPath)
+				return nil
+			}
+		}
 
 		// For files, use restoreFile which handles permissions and copying
-		return restoreFile(path, dstPath, dryRun)
+		if err := r.restoreFile(path, dstPath, metaPath); err != nil {
+			return err
+		}
+		r.applyMetadata(dstPath, metaPath)
+		return nil
 	})
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		r.applyMetadata(filepath.Join(dst, dirs[i]), filepath.Join(relRoot, dirs[i]))
+	}
+	for _, link := range links {
+		warnIfDangling(link)
+	}
+	return err
 }
@@ -2,29 +2,27 @@
 package restore
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/kennyparsons/gitbak/backup"
 )
 
-// loadMetadata loads metadata from the backup directory
+// loadMetadata loads the metadata of every app from the backup directory.
+// Both the current and the legacy metadata file format are understood.
 func loadMetadata(backupRoot string) ([]backup.FileMetadata, error) {
-	metadataPath := filepath.Join(backupRoot, backup.MetadataFileName)
-	data, err := os.ReadFile(metadataPath)
+	metadata, err := backup.LoadMetadata(backupRoot)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read metadata file: %v", err)
-	}
-
-	var metadata []backup.FileMetadata
-	if err := json.Unmarshal(data, &metadata); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal metadata: %v", err)
+		return nil, err
 	}
+	return metadata.Files(), nil
+}
 
-	return metadata, nil
+// needsRoot reports whether restoring the ownership in meta takes root
+// privileges this process doesn't have
+func needsRoot(meta backup.FileMetadata) bool {
+	return os.Geteuid() != 0 && (meta.Uid != os.Getuid() || meta.Gid != os.Getgid())
 }
 
 // applyMetadata applies the stored metadata to a file or directory
@@ -39,24 +37,39 @@ func applyMetadata(targetPath string, meta backup.FileMetadata, dryRun bool) err
 		return fmt.Errorf("target file does not exist: %s", targetPath)
 	}
 
+	// Mode, xattrs and times would apply to the link's target, so only
+	// ownership is restored for symlinks
+	if meta.Mode&os.ModeSymlink != 0 {
+		if os.Geteuid() == 0 {
+			if err := os.Lchown(targetPath, meta.Uid, meta.Gid); err != nil {
+				return fmt.Errorf("failed to set ownership for %s: %v", targetPath, err)
+			}
+		}
+		return nil
+	}
+
 	// Set file mode
 	if err := os.Chmod(targetPath, meta.Mode); err != nil {
 		return fmt.Errorf("failed to set mode for %s: %v", targetPath, err)
 	}
 
-	// Set ownership (requires root)
+	// Set ownership (requires root); the restorer reports the files it
+	// couldn't set it for once, at the end
 	if os.Geteuid() == 0 {
 		if err := os.Chown(targetPath, meta.Uid, meta.Gid); err != nil {
 			return fmt.Errorf("failed to set ownership for %s: %v", targetPath, err)
 		}
-	} else if meta.Uid != os.Getuid() || meta.Gid != os.Getgid() {
-		fmt.Printf("  [warning] Need root to set ownership for %s (UID: %d, GID: %d)\n",
-			targetPath, meta.Uid, meta.Gid)
 	}
 
 	// Set extended attributes
 	for _, xattr := range meta.Xattrs {
 		if err := setXattr(targetPath, xattr); err != nil {
+			// security.* attributes need privileges we may not have, and
+			// the target filesystem may not support xattrs at all
+			if isXattrPermissionError(err) {
+				fmt.Printf("  [warning] Could not set xattr %s on %s: %v\n", xattr.Name, targetPath, err)
+				continue
+			}
 			return fmt.Errorf("failed to set xattr %s on %s: %v",
 				xattr.Name, targetPath, err)
 		}
@@ -73,10 +86,3 @@ func applyMetadata(targetPath string, meta backup.FileMetadata, dryRun bool) err
 
 	return nil
 }
-
-// setXattr sets an extended attribute (platform-specific)
-func setXattr(path string, xattr backup.Xattr) error {
-	// This is a basic implementation that works on Unix-like systems
-	// For a complete implementation, you might want to use a library like github.com/pkg/xattr
-	return nil
-}
@@ -0,0 +1,307 @@
+package restore
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kennyparsons/gitbak/backup"
+	"github.com/kennyparsons/gitbak/config"
+)
+
+func TestParseConflictPolicy(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    ConflictPolicy
+		wantErr bool
+	}{
+		{input: "", want: PolicyAsk},
+		{input: "skip", want: PolicySkip},
+		{input: "Overwrite", want: PolicyOverwrite},
+		{input: " newer ", want: PolicyNewer},
+		{input: "fail", want: PolicyFail},
+		{input: "clobber", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseConflictPolicy(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConflictPolicy(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseConflictPolicy(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreDirectoryAppliesMetadata(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "backup", "ssh", ".ssh")
+	dst := filepath.Join(root, "live", ".ssh")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// git only tracks the executable bit, so the backup copy is 0644
+	if err := os.WriteFile(filepath.Join(src, "id_ed25519"), []byte("key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &restorer{policy: PolicyOverwrite, metadata: map[string]backup.FileMetadata{
+		filepath.Join("ssh", ".ssh"):               {Mode: os.ModeDir | 0700, Uid: os.Getuid(), Gid: os.Getgid()},
+		filepath.Join("ssh", ".ssh", "id_ed25519"): {Mode: 0600, Uid: os.Getuid(), Gid: os.Getgid()},
+	}}
+	if err := r.restoreDirectory(context.Background(), src, dst, filepath.Join("ssh", ".ssh")); err != nil {
+		t.Fatalf("restoreDirectory() error = %v", err)
+	}
+
+	for path, want := range map[string]os.FileMode{dst: 0700, filepath.Join(dst, "id_ed25519"): 0600} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("mode of %s = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestRestoreFileUsesRecordedMode(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "backup", "ssh", "id_ed25519")
+	dst := filepath.Join(root, "live", "id_ed25519")
+	for _, dir := range []string{filepath.Dir(src), filepath.Dir(dst)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// As checked out by git
+	if err := os.WriteFile(src, []byte("key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// restoreFile alone, without the metadata applied afterwards, must
+	// already put the file in place with its recorded mode
+	relPath := filepath.Join("ssh", "id_ed25519")
+	r := &restorer{policy: PolicyOverwrite, metadata: map[string]backup.FileMetadata{relPath: {Mode: 0600}}}
+	if err := r.restoreFile(src, dst, relPath); err != nil {
+		t.Fatalf("restoreFile() error = %v", err)
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode of restored key = %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+}
+
+func TestRestoreDirectoryRendersTemplates(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "backup", "git", "git")
+	dst := filepath.Join(root, "live", "git")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"config.tmpl": "[user]\n\temail = {{.Vars.email}}\n{{if eq .OS \"plan9\"}}\tname = glenda\n{{end}}",
+		"hooks.tmpl":  "{{not a template}}",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &restorer{
+		policy: PolicyOverwrite,
+		metadata: map[string]backup.FileMetadata{
+			// Backed up from a live file called hooks.tmpl
+			filepath.Join("git", "git", "hooks.tmpl"): {Mode: 0644, Uid: os.Getuid(), Gid: os.Getgid()},
+		},
+		templateData: TemplateData{OS: "linux", Vars: map[string]string{"email": "me@work.example"}},
+	}
+	if err := r.restoreDirectory(context.Background(), src, dst, filepath.Join("git", "git")); err != nil {
+		t.Fatalf("restoreDirectory() error = %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"config":     "[user]\n\temail = me@work.example\n",
+		"hooks.tmpl": "{{not a template}}",
+	} {
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "config.tmpl")); !os.IsNotExist(err) {
+		t.Errorf("config.tmpl was restored as is")
+	}
+
+	r.templateData.Vars = nil
+	if err := r.restoreDirectory(context.Background(), src, dst, filepath.Join("git", "git")); err == nil {
+		t.Error("restoreDirectory() rendered a template with a missing variable")
+	}
+}
+
+func TestRollbackJournal(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "backup", "zsh", "zsh")
+	dst := filepath.Join(root, "live", "zsh")
+	for _, dir := range []string{src, dst} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{"zshrc": "restored", "new": "new"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("restored-target", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The live state the rollback has to bring back
+	zshrc := filepath.Join(dst, "zshrc")
+	if err := os.WriteFile(zshrc, []byte("live"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(zshrc, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("live-target", filepath.Join(dst, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &restorer{policy: PolicyOverwrite, journal: newJournal(filepath.Join(root, "journals"))}
+	if err := r.restoreDirectory(context.Background(), src, dst, filepath.Join("zsh", "zsh")); err != nil {
+		t.Fatalf("restoreDirectory() error = %v", err)
+	}
+	r.journal.close()
+	if data, _ := os.ReadFile(zshrc); string(data) != "restored" {
+		t.Fatalf("zshrc = %q after restore, want %q", data, "restored")
+	}
+
+	if err := rollbackJournal(r.journal.dir); err != nil {
+		t.Fatalf("rollbackJournal() error = %v", err)
+	}
+
+	info, err := os.Stat(zshrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(zshrc); string(data) != "live" {
+		t.Errorf("zshrc = %q, want %q", data, "live")
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode of zshrc = %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("mtime of zshrc = %v, want %v", info.ModTime(), modTime)
+	}
+	if target, _ := os.Readlink(filepath.Join(dst, "link")); target != "live-target" {
+		t.Errorf("link points to %q, want %q", target, "live-target")
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "new")); !os.IsNotExist(err) {
+		t.Errorf("file created by the restore still exists: %v", err)
+	}
+	if _, err := os.Stat(r.journal.dir); !os.IsNotExist(err) {
+		t.Errorf("journal was not removed after rolling back: %v", err)
+	}
+}
+
+func TestRollbackFailedMove(t *testing.T) {
+	root := t.TempDir()
+	zshrc := filepath.Join(root, "live", "zshrc")
+	if err := os.MkdirAll(filepath.Dir(zshrc), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(zshrc, []byte("live"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The move is journaled before it is made, and this one fails
+	r := &restorer{policy: PolicyBackup, journal: newJournal(filepath.Join(root, "journals"))}
+	if err := r.backupExisting(filepath.Join(root, "live", "missing")); err == nil {
+		t.Fatal("backupExisting() moved a file that doesn't exist")
+	}
+	if err := r.backupExisting(zshrc); err != nil {
+		t.Fatalf("backupExisting() error = %v", err)
+	}
+	r.journal.close()
+	if entries, err := readJournal(r.journal.dir); err != nil || len(entries) != 2 {
+		t.Fatalf("journal = %+v, %v, want both moves", entries, err)
+	}
+
+	if err := rollbackJournal(r.journal.dir); err != nil {
+		t.Fatalf("rollbackJournal() error = %v", err)
+	}
+	if data, _ := os.ReadFile(zshrc); string(data) != "live" {
+		t.Errorf("zshrc = %q after rolling back, want %q", data, "live")
+	}
+}
+
+func TestRestoreFromHistory(t *testing.T) {
+	root := t.TempDir()
+	backupDir := filepath.Join(root, "backup")
+	live := filepath.Join(root, "live", ".zshrc")
+	if err := os.MkdirAll(filepath.Join(backupDir, "zsh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	git := func(date string, args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", backupDir}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t",
+			"GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s failed: %v - %s", strings.Join(args, " "), err, out)
+		}
+	}
+	git("", "init", "--quiet")
+	for _, c := range []struct{ content, date string }{
+		{"first", "2026-09-01T12:00:00Z"},
+		{"second", "2026-09-10T12:00:00Z"},
+	} {
+		if err := os.WriteFile(filepath.Join(backupDir, "zsh", ".zshrc"), []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git(c.date, "add", "-A")
+		git(c.date, "commit", "--quiet", "-m", c.content)
+		git(c.date, "tag", c.content)
+	}
+
+	cfg := &config.Config{BackupDir: backupDir, CustomApps: map[string]config.AppConfig{"zsh": {Paths: []string{live}}}}
+	for _, tt := range []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{name: "rev", opts: Options{Rev: "first"}, want: "first"},
+		{name: "at", opts: Options{At: "2026-09-05"}, want: "first"},
+		{name: "at later", opts: Options{At: "2026-09-11"}, want: "second"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.OnConflict = PolicyOverwrite
+			tt.opts.JournalDir = filepath.Join(root, "journals")
+			if err := Restore(context.Background(), cfg, tt.opts, nil); err != nil {
+				t.Fatalf("Restore() error = %v", err)
+			}
+			if data, _ := os.ReadFile(live); string(data) != tt.want {
+				t.Errorf(".zshrc = %q, want %q", data, tt.want)
+			}
+		})
+	}
+	if data, _ := os.ReadFile(filepath.Join(backupDir, "zsh", ".zshrc")); string(data) != "second" {
+		t.Errorf("backup_dir was changed by restoring from history: %q", data)
+	}
+}
@@ -0,0 +1,88 @@
+package restore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/kennyparsons/gitbak/backup"
+	"github.com/kennyparsons/gitbak/config"
+)
+
+// TemplateData is what templates in backup_dir are rendered with
+type TemplateData struct {
+	Hostname string // As reported by the system
+	Host     string // The name this machine's backups are stored under
+	OS       string // runtime.GOOS, e.g. "darwin" or "linux"
+	Arch     string // runtime.GOARCH, e.g. "arm64" or "amd64"
+	User     string
+	Home     string
+	// Vars holds the vars from the config, with the host_vars of this
+	// machine on top
+	Vars map[string]string
+}
+
+// newTemplateData returns the template data for this machine
+func newTemplateData(cfg *config.Config) TemplateData {
+	hostname, _ := os.Hostname()
+	home, _ := os.UserHomeDir()
+	username := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	return TemplateData{
+		Hostname: hostname,
+		Host:     cfg.Host(),
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		User:     username,
+		Home:     home,
+		Vars:     cfg.TemplateVars(),
+	}
+}
+
+// renderTemplate renders the template text with data. Using a variable that
+// isn't set is an error rather than an empty string.
+func renderTemplate(name string, text []byte, data TemplateData) ([]byte, error) {
+	t, err := template.New(name).Funcs(template.FuncMap{
+		"env": os.Getenv,
+	}).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %s: %v", name, err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render template %s: %v", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// isTemplate reports whether the backup file at relPath is a template. Live
+// files whose own name ends in backup.TemplateSuffix are recorded as plain
+// copies and restored as they are.
+func (r *restorer) isTemplate(relPath string) bool {
+	if !strings.HasSuffix(relPath, backup.TemplateSuffix) {
+		return false
+	}
+	meta, ok := r.metadata[relPath]
+	return !ok || meta.Template
+}
+
+// render renders the contents of the template at src
+func (r *restorer) render(contents io.Reader, src string) (io.Reader, error) {
+	text, err := io.ReadAll(contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source file: %v", err)
+	}
+	data, err := renderTemplate(filepath.Base(src), text, r.templateData)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
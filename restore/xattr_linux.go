@@ -0,0 +1,26 @@
+//go:build linux
+
+package restore
+
+import (
+	"encoding/base64"
+	"fmt"
+	"syscall"
+
+	"github.com/kennyparsons/gitbak/backup"
+)
+
+// setXattr sets an extended attribute from its base64-encoded backup value
+func setXattr(path string, xattr backup.Xattr) error {
+	value, err := base64.StdEncoding.DecodeString(xattr.Value)
+	if err != nil {
+		return fmt.Errorf("invalid value: %v", err)
+	}
+	return syscall.Setxattr(path, xattr.Name, value, 0)
+}
+
+// isXattrPermissionError reports whether err means the xattr could not be set
+// for lack of privileges or filesystem support rather than a real failure
+func isXattrPermissionError(err error) bool {
+	return err == syscall.EPERM || err == syscall.EACCES || err == syscall.ENOTSUP
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package restore
+
+import (
+	"github.com/kennyparsons/gitbak/backup"
+)
+
+// setXattr sets an extended attribute. They are only supported on Linux for
+// now, so attributes recorded there are skipped.
+func setXattr(path string, xattr backup.Xattr) error {
+	return nil
+}
+
+func isXattrPermissionError(err error) bool {
+	return false
+}
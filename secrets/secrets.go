@@ -0,0 +1,192 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/kennyparsons/gitbak/backup"
+	"github.com/kennyparsons/gitbak/config"
+	"github.com/kennyparsons/gitbak/git"
+	"github.com/kennyparsons/gitbak/internal/crypt"
+)
+
+// Rule is a pattern for something that looks like a secret
+type Rule struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// builtinRules cover the credentials most likely to end up in dotfiles
+var builtinRules = []Rule{
+	{"private key", regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY(?: BLOCK)?-----`)},
+	{"AWS access key ID", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"AWS secret access key", regexp.MustCompile(`(?i)aws_secret_access_key["']?\s*[:=]\s*["']?[A-Za-z0-9/+=]{40}\b`)},
+	{"GCP service account key", regexp.MustCompile(`"type"\s*:\s*"service_account"`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`)},
+	{"GitHub token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`)},
+}
+
+// Candidates for the high-entropy check: long runs of base64 characters
+var tokenPattern = regexp.MustCompile(`[A-Za-z0-9+/_\-]{32,}={0,2}`)
+
+// Shannon entropy in bits per character above which a token is reported.
+// Random base64 tokens of 32 characters score around 4.7 and longer ones
+// more, while identifiers and paths stay below.
+const entropyThreshold = 4.5
+
+// Finding is a line that looks like it contains a secret
+type Finding struct {
+	Path  string // Relative to backup_dir
+	Line  int
+	Rule  string
+	Match string // Redacted, so the report doesn't leak the secret itself
+}
+
+// Check scans the files the next backup commit would pick up for secrets,
+// using the built-in rules and the secret_patterns from the config
+func Check(cfg *config.Config) ([]Finding, error) {
+	rules, err := Rules(cfg.SecretPatterns)
+	if err != nil {
+		return nil, err
+	}
+	files, err := git.PendingFiles(cfg.BackupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []Finding
+	for _, path := range files {
+		switch filepath.Base(path) {
+		case backup.MetadataFileName, crypt.ParamsFileName:
+			// gitbak's own files hold base64 that isn't secret
+			continue
+		}
+		found, err := scanFile(path, rules)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(cfg.BackupDir, path)
+		if err != nil {
+			rel = path
+		}
+		for _, f := range found {
+			f.Path = rel
+			findings = append(findings, f)
+		}
+	}
+	return findings, nil
+}
+
+// Rules returns the built-in rules followed by one rule per user pattern
+func Rules(patterns []string) ([]Rule, error) {
+	rules := append([]Rule(nil), builtinRules...)
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret pattern %q: %v", p, err)
+		}
+		rules = append(rules, Rule{Name: "secret_patterns: " + p, Pattern: re})
+	}
+	return rules, nil
+}
+
+// scanFile reports every line of a file that matches a rule or contains a
+// high-entropy token. Binary and encrypted files are skipped.
+func scanFile(path string, rules []Rule) ([]Finding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	head, _ := r.Peek(8000)
+	if crypt.IsEncrypted(head) || bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+
+	var findings []Finding
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			findings = append(findings, scanLine(line, lineNo, rules)...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+	}
+	return findings, nil
+}
+
+// scanLine reports the first rule a line matches, or a high-entropy token
+func scanLine(line string, lineNo int, rules []Rule) []Finding {
+	for _, rule := range rules {
+		if m := rule.Pattern.FindString(line); m != "" {
+			return []Finding{{Line: lineNo, Rule: rule.Name, Match: redact(m)}}
+		}
+	}
+	for _, token := range tokenPattern.FindAllString(line, -1) {
+		if looksRandom(token) {
+			return []Finding{{Line: lineNo, Rule: "high-entropy string", Match: redact(token)}}
+		}
+	}
+	return nil
+}
+
+// looksRandom reports whether token mixes upper case, lower case and digits
+// with an entropy above entropyThreshold
+func looksRandom(token string) bool {
+	var upper, lower, digit bool
+	counts := make(map[rune]int)
+	for _, c := range token {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9':
+			digit = true
+		}
+		counts[c]++
+	}
+	if !upper || !lower || !digit {
+		return false
+	}
+	return entropy(counts, len(token)) > entropyThreshold
+}
+
+// entropy returns the Shannon entropy in bits per character of a string with
+// the given character counts and length
+func entropy(counts map[rune]int, length int) float64 {
+	var h float64
+	for _, n := range counts {
+		p := float64(n) / float64(length)
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// redact keeps just enough of a match to recognize it
+func redact(s string) string {
+	if len(s) <= 12 {
+		return s[:len(s)/2] + "…"
+	}
+	return s[:8] + "…"
+}
+
+// Print reports findings one per line
+func Print(findings []Finding) {
+	for _, f := range findings {
+		fmt.Printf("  %s:%d: %s (%s)\n", f.Path, f.Line, f.Rule, f.Match)
+	}
+}
@@ -0,0 +1,48 @@
+package status
+
+import (
+	"fmt"
+
+	"github.com/kennyparsons/gitbak/backup"
+	"github.com/kennyparsons/gitbak/config"
+	"github.com/kennyparsons/gitbak/internal/utils"
+)
+
+// Status prints, per app, which live files are new, modified or deleted
+// relative to the backup directory. Unchanged files are only listed when
+// verbose is set. It returns true if any app has drifted from its backup.
+// If appName is not empty, only that app is checked.
+func Status(cfg *config.Config, appName string, verbose bool, overrides []utils.PathOverride) (bool, error) {
+	statuses, err := backup.Scan(cfg, appName, overrides)
+	if err != nil {
+		return false, err
+	}
+
+	drifted := false
+	for _, app := range statuses {
+		counts := make(map[backup.Change]int)
+		for _, f := range app.Files {
+			counts[f.Change]++
+		}
+
+		if !app.Drifted() {
+			fmt.Printf("● %s: up to date (%d files)\n", app.Name, counts[backup.Unchanged])
+			if !verbose {
+				continue
+			}
+		} else {
+			drifted = true
+			fmt.Printf("● %s: %d new, %d modified, %d deleted, %d unchanged\n", app.Name,
+				counts[backup.Added], counts[backup.Modified], counts[backup.Deleted], counts[backup.Unchanged])
+		}
+
+		for _, f := range app.Files {
+			if f.Change == backup.Unchanged && !verbose {
+				continue
+			}
+			fmt.Printf("  %-11s %s\n", "["+f.Change.String()+"]", f.Path)
+		}
+	}
+
+	return drifted, nil
+}
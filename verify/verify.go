@@ -0,0 +1,161 @@
+package verify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kennyparsons/gitbak/backup"
+	"github.com/kennyparsons/gitbak/config"
+)
+
+// Problem kinds reported by Verify
+const (
+	// Corrupt files no longer match the checksum recorded at backup time
+	Corrupt = "corrupt"
+	// Missing files are recorded in the metadata but absent from backup_dir
+	Missing = "missing"
+	// Unrecorded files exist in backup_dir but not in the metadata
+	Unrecorded = "unrecorded"
+)
+
+// Problem is a single integrity issue found in the backup directory
+type Problem struct {
+	Kind string
+	Path string // Relative to backup_dir
+}
+
+// Verify re-hashes the files under the backup directory and compares them
+// against the checksums recorded in the metadata file. It prints a summary
+// per app and returns true if any problem was found. If appName is not
+// empty, only that app is checked.
+func Verify(cfg *config.Config, appName string) (bool, error) {
+	metadata, err := backup.LoadMetadata(cfg.BackupDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to load metadata: %v", err)
+	}
+
+	var names []string
+	if appName != "" {
+		if _, ok := metadata.Apps[appName]; !ok {
+			if _, ok := cfg.CustomApps[appName]; !ok {
+				return false, fmt.Errorf("app %s not found in config", appName)
+			}
+		}
+		names = []string{appName}
+	} else {
+		// Directories in backup_dir that no metadata section covers are
+		// checked too, so their files show up as unrecorded
+		seen := make(map[string]bool)
+		for name := range metadata.Apps {
+			seen[name] = true
+		}
+		entries, err := os.ReadDir(cfg.BackupDir)
+		if err != nil {
+			return false, fmt.Errorf("failed to read backup directory: %v", err)
+		}
+		for _, e := range entries {
+			if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				seen[e.Name()] = true
+			}
+		}
+		for name := range seen {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	failed := false
+	for _, name := range names {
+		problems, verified, unverified, err := verifyApp(cfg.BackupDir, name, metadata.Apps[name])
+		if err != nil {
+			return failed, fmt.Errorf("%s: %v", name, err)
+		}
+
+		summary := fmt.Sprintf("%d files verified", verified)
+		if unverified > 0 {
+			// Recorded by a gitbak version that didn't store checksums yet
+			summary += fmt.Sprintf(", %d without checksum", unverified)
+		}
+		if len(problems) == 0 {
+			fmt.Printf("● %s: ok (%s)\n", name, summary)
+			continue
+		}
+
+		failed = true
+		fmt.Printf("● %s: %d problem(s) (%s)\n", name, len(problems), summary)
+		for _, p := range problems {
+			fmt.Printf("  %-12s %s\n", "["+p.Kind+"]", p.Path)
+		}
+	}
+
+	return failed, nil
+}
+
+// verifyApp checks the backup of a single app. It returns the problems found
+// along with how many files matched their checksum and how many had none.
+func verifyApp(backupDir, name string, app backup.AppMetadata) (problems []Problem, verified, unverified int, err error) {
+	recorded := make(map[string]bool)
+	for _, file := range app.Files {
+		recorded[file.Path] = true
+		if file.Mode.IsDir() {
+			if _, err := os.Stat(filepath.Join(backupDir, file.Path)); os.IsNotExist(err) {
+				problems = append(problems, Problem{Kind: Missing, Path: file.Path})
+			}
+			continue
+		}
+
+		if file.Link != "" {
+			target, err := os.Readlink(filepath.Join(backupDir, file.Path))
+			switch {
+			case os.IsNotExist(err):
+				problems = append(problems, Problem{Kind: Missing, Path: file.Path})
+			case err != nil || target != file.Link:
+				problems = append(problems, Problem{Kind: Corrupt, Path: file.Path})
+			default:
+				verified++
+			}
+			continue
+		}
+
+		sum, err := backup.FileChecksum(filepath.Join(backupDir, file.Path))
+		switch {
+		case os.IsNotExist(err):
+			problems = append(problems, Problem{Kind: Missing, Path: file.Path})
+		case err != nil:
+			return nil, 0, 0, err
+		case file.SHA256 == "":
+			unverified++
+		case sum != file.SHA256:
+			problems = append(problems, Problem{Kind: Corrupt, Path: file.Path})
+		default:
+			verified++
+		}
+	}
+
+	appDir := filepath.Join(backupDir, name)
+	err = filepath.Walk(appDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == appDir {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(backupDir, path)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !recorded[rel] {
+			problems = append(problems, Problem{Kind: Unrecorded, Path: rel})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Path < problems[j].Path })
+	return problems, verified, unverified, nil
+}
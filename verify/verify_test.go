@@ -0,0 +1,56 @@
+package verify
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kennyparsons/gitbak/backup"
+)
+
+func TestVerifyApp(t *testing.T) {
+	root := t.TempDir()
+	write := func(rel, content string) string {
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := backup.FileChecksum(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+
+	goodSum := write("nvim/nvim/init.lua", "good")
+	badSum := write("nvim/nvim/plugins.lua", "original")
+	write("nvim/nvim/plugins.lua", "bit rot")
+	write("nvim/nvim/stray.lua", "stray")
+
+	app := backup.AppMetadata{Files: []backup.FileMetadata{
+		{Path: "nvim/nvim", Mode: os.ModeDir | 0755},
+		{Path: "nvim/nvim/init.lua", SHA256: goodSum},
+		{Path: "nvim/nvim/plugins.lua", SHA256: badSum},
+		{Path: "nvim/nvim/gone.lua", SHA256: goodSum},
+	}}
+	problems, verified, unverified, err := verifyApp(root, "nvim", app)
+	if err != nil {
+		t.Fatalf("verifyApp() error = %v", err)
+	}
+
+	want := []Problem{
+		{Kind: Missing, Path: "nvim/nvim/gone.lua"},
+		{Kind: Corrupt, Path: "nvim/nvim/plugins.lua"},
+		{Kind: Unrecorded, Path: "nvim/nvim/stray.lua"},
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("problems = %v, want %v", problems, want)
+	}
+	if verified != 1 || unverified != 0 {
+		t.Errorf("verified, unverified = %d, %d, want 1, 0", verified, unverified)
+	}
+}